@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// openTreeFS picks a file system for root: zip and tar archives are browsed in place,
+// anything else is treated as a directory on disk, a regular file as one with nothing below it.
+func openTreeFS(root string) (fs.FS, io.Closer, error) {
+	var name = strings.ToLower(root)
+
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		var reader, err = zip.OpenReader(root)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open zip archive '%s', error %s", root, err)
+		}
+		return zipFS{reader}, reader, nil
+
+	case strings.HasSuffix(name, ".tar"):
+		return openTarFS(root, false)
+
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return openTarFS(root, true)
+
+	default:
+		if info, err := os.Stat(root); err == nil && !info.IsDir() {
+			return fileFS(root), nopCloser{}, nil
+		}
+		return os.DirFS(root), nopCloser{}, nil
+	}
+}
+
+// fileFS is a file given as the root, "." is the file itself.
+type fileFS string
+
+func (f fileFS) Open(name string) (fs.File, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return os.Open(string(f))
+}
+
+// zipFS reads links of a zip archive, which stores the target of a link as its contents.
+type zipFS struct {
+	*zip.ReadCloser
+}
+
+// Lstat is the same as Stat, zip.Reader never follows links.
+func (z zipFS) Lstat(name string) (fs.FileInfo, error) {
+	return fs.Stat(z.ReadCloser, name)
+}
+
+func (z zipFS) ReadLink(name string) (string, error) {
+	var info, err = z.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := fs.ReadFile(z.ReadCloser, name)
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+func openTarFS(archivePath string, gzipped bool) (fs.FS, io.Closer, error) {
+	var fsys = &tarFS{
+		open: func() (io.ReadCloser, error) {
+			return openTarStream(archivePath, gzipped)
+		},
+	}
+
+	var err = fsys.index()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read tar archive '%s', error %s", archivePath, err)
+	}
+	return fsys, nopCloser{}, nil
+}
+
+type tarStream struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *tarStream) Close() error {
+	var errs = make([]error, 0)
+	for _, closer := range slices.Backward(s.closers) {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func openTarStream(archivePath string, gzipped bool) (io.ReadCloser, error) {
+	var file, err = os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if !gzipped {
+		return file, nil
+	}
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &tarStream{Reader: gzipReader, closers: []io.Closer{file, gzipReader}}, nil
+}
+
+type tarEntry struct {
+	info   fs.FileInfo
+	header *tar.Header
+	// position is the number of headers before the one describing the entry.
+	position int
+	// children are the sorted names of the entries in a directory, their info is looked up
+	// when listed as a later header may replace it.
+	children []string
+}
+
+// tarFS keeps only the headers of a tar archive in memory.
+// Tar has no index, so reading a file scans the archive from the start again;
+// listing the tree needs a single pass.
+type tarFS struct {
+	open    func() (io.ReadCloser, error)
+	entries map[string]*tarEntry
+}
+
+func (t *tarFS) index() error {
+	t.entries = map[string]*tarEntry{
+		".": {info: syntheticDirInfo(".")},
+	}
+
+	var stream, err = t.open()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	var reader = tar.NewReader(stream)
+	for position := 0; ; position++ {
+		var header, err = reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var name = path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == "." || !fs.ValidPath(name) {
+			continue
+		}
+
+		t.ensureDir(path.Dir(name))
+		if entry, ok := t.entries[name]; ok {
+			// a directory created implicitly earlier or a member appended again, the last header wins
+			entry.info, entry.header, entry.position = header.FileInfo(), header, position
+			continue
+		}
+		t.entries[name] = &tarEntry{info: header.FileInfo(), header: header, position: position}
+		t.addChild(name)
+	}
+
+	for _, entry := range t.entries {
+		// siblings share the parent prefix, so sorting paths sorts their names
+		slices.Sort(entry.children)
+	}
+	return nil
+}
+
+func (t *tarFS) ensureDir(name string) {
+	if _, ok := t.entries[name]; ok {
+		return
+	}
+	t.ensureDir(path.Dir(name))
+	t.entries[name] = &tarEntry{info: syntheticDirInfo(path.Base(name))}
+	t.addChild(name)
+}
+
+func (t *tarFS) addChild(name string) {
+	var parent = t.entries[path.Dir(name)]
+	parent.children = append(parent.children, name)
+}
+
+func (t *tarFS) dirEntries(names []string) []fs.DirEntry {
+	return mapped(&names, func(_ int, name string) fs.DirEntry {
+		return fs.FileInfoToDirEntry(t.entries[name].info)
+	})
+}
+
+func (t *tarFS) lookup(operation string, name string) (*tarEntry, error) {
+	var entry, ok = t.entries[name]
+	if !fs.ValidPath(name) || !ok {
+		return nil, &fs.PathError{Op: operation, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	var entry, err = t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &tarFile{fsys: t, name: name, entry: entry}, nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entry, err = t.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return t.dirEntries(entry.children), nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	var entry, err = t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+// Lstat is the same as Stat, links inside an archive are shown but never followed.
+func (t *tarFS) Lstat(name string) (fs.FileInfo, error) {
+	return t.Stat(name)
+}
+
+func (t *tarFS) ReadLink(name string) (string, error) {
+	var entry, err = t.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if entry.header == nil || entry.header.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return entry.header.Linkname, nil
+}
+
+// tarFile streams the contents of one archive member on the first Read.
+type tarFile struct {
+	fsys      *tarFS
+	name      string
+	entry     *tarEntry
+	stream    io.ReadCloser
+	reader    io.Reader
+	dirOffset int
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.entry.info, nil
+}
+
+func (f *tarFile) Read(buffer []byte) (int, error) {
+	if f.entry.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+
+	if f.reader == nil {
+		var err = f.seek()
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+	}
+	return f.reader.Read(buffer)
+}
+
+func (f *tarFile) seek() error {
+	var stream, err = f.fsys.open()
+	if err != nil {
+		return err
+	}
+	f.stream = stream
+
+	var reader = tar.NewReader(stream)
+	for position := 0; ; position++ {
+		var _, err = reader.Next()
+		if err != nil {
+			return err
+		}
+		if position == f.entry.position {
+			f.reader = reader
+			return nil
+		}
+	}
+}
+
+func (f *tarFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	var children = f.entry.children[f.dirOffset:]
+	if count > 0 && len(children) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && count < len(children) {
+		children = children[:count]
+	}
+	f.dirOffset += len(children)
+	return f.fsys.dirEntries(children), nil
+}
+
+func (f *tarFile) Close() error {
+	if f.stream == nil {
+		return nil
+	}
+	return f.stream.Close()
+}
+
+// syntheticDirInfo describes directories that only exist implicitly as path prefixes.
+type syntheticDirInfo string
+
+func (d syntheticDirInfo) Name() string       { return string(d) }
+func (d syntheticDirInfo) Size() int64        { return 0 }
+func (d syntheticDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (d syntheticDirInfo) ModTime() time.Time { return time.Time{} }
+func (d syntheticDirInfo) IsDir() bool        { return true }
+func (d syntheticDirInfo) Sys() any           { return nil }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+const (
+	columnPermissions = "perm"
+	columnOwner       = "owner"
+	columnMtime       = "mtime"
+)
+
+const mtimeLayout = "2006-01-02 15:04"
+
+// columnsFlag parses a comma separated list like --columns=perm,owner,mtime.
+type columnsFlag []string
+
+func (c *columnsFlag) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *columnsFlag) Set(value string) error {
+	for _, column := range strings.Split(value, ",") {
+		switch column {
+		case columnPermissions, columnOwner, columnMtime:
+			*c = append(*c, column)
+		default:
+			return fmt.Errorf("unknown column '%s'", column)
+		}
+	}
+	return nil
+}
+
+// formatColumns renders the requested metadata in the order the columns were given.
+func formatColumns(columns []string, fileMetadata FileMetadata) string {
+	var values = make([]string, 0, len(columns))
+
+	for _, column := range columns {
+		switch column {
+		case columnPermissions:
+			values = append(values, fileMetadata.Mode.String())
+		case columnOwner:
+			values = append(values, fileMetadata.Owner)
+		case columnMtime:
+			values = append(values, fileMetadata.ModTime.Format(mtimeLayout))
+		}
+	}
+
+	return strings.Join(values, " ")
+}
+
+// entryOwner prefers the user name recorded in a tar header over the local file owner.
+func entryOwner(fileInfo fs.FileInfo) string {
+	if header, ok := fileInfo.Sys().(*tar.Header); ok && header.Uname != "" {
+		return header.Uname
+	}
+	return fileOwner(fileInfo)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+const (
+	diffStatusAdded   = "added"
+	diffStatusRemoved = "removed"
+	diffStatusChanged = "changed"
+)
+
+// diffSide is one of the two trees being compared.
+type diffSide struct {
+	fsys        fs.FS
+	entryFilter *entryFilter
+	reader      *dirReader
+}
+
+func newDiffSide(fsys fs.FS, options TreeOptions) (*diffSide, error) {
+	var entryFilter, err = newEntryFilter(fsys, ".", options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diffSide{
+		fsys:        fsys,
+		entryFilter: entryFilter,
+		reader:      newDirReader(fsys, options.Workers),
+	}, nil
+}
+
+// children lists the entries of dirPath keyed by name, a missing side has no children.
+func (s *diffSide) children(dirPath string, dirInfo fs.FileInfo) (map[string]fs.FileInfo, error) {
+	var result = map[string]fs.FileInfo{}
+	if dirInfo == nil || !dirInfo.IsDir() {
+		return result, nil
+	}
+
+	var entries, err = s.reader.read(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file '%s', error %s", dirPath, err)
+	}
+
+	err = s.entryFilter.enterDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !s.entryFilter.accepts(dirPath, entry) {
+			continue
+		}
+
+		var info, err = entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("cannot open file '%s': error %s", path.Join(dirPath, entry.Name()), err)
+		}
+		if entry.IsDir() {
+			s.reader.prefetch(path.Join(dirPath, entry.Name()))
+		}
+		result[entry.Name()] = info
+	}
+	return result, nil
+}
+
+func (s *diffSide) linkTarget(filePath string, fileInfo fs.FileInfo) (string, error) {
+	if fileInfo == nil || fileInfo.Mode()&fs.ModeSymlink == 0 {
+		return "", nil
+	}
+
+	var target, err = fs.ReadLink(s.fsys, filePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read link '%s': error %s", filePath, err)
+	}
+	return target, nil
+}
+
+type diffPair struct {
+	fileMetadata FileMetadata
+	oldInfo      fs.FileInfo
+	newInfo      fs.FileInfo
+}
+
+// diffStatus compares one path present in either tree, directories are never "changed"
+// themselves, the difference shows up in their children.
+func diffStatus(oldInfo, newInfo fs.FileInfo, oldTarget, newTarget string) string {
+	switch {
+	case oldInfo == nil:
+		return diffStatusAdded
+	case newInfo == nil:
+		return diffStatusRemoved
+	case oldInfo.Mode().Type() != newInfo.Mode().Type():
+		return diffStatusChanged
+	case oldInfo.IsDir():
+		return ""
+	case oldInfo.Size() != newInfo.Size() || oldTarget != newTarget:
+		return diffStatusChanged
+	default:
+		return ""
+	}
+}
+
+// walkDiff walks both trees in lock-step: children of each directory are merged by name
+// and emitted as one FileMetadata stream, so every renderer can show the merged tree.
+func walkDiff(
+	oldSide *diffSide,
+	newSide *diffSide,
+	rootName string,
+	visit func(fileMetadata FileMetadata) error,
+) (bool, error) {
+	const root = "."
+
+	var oldRootInfo, err = fs.Stat(oldSide.fsys, root)
+	if err != nil {
+		return false, fmt.Errorf("cannot open file '%s': error %s", root, err)
+	}
+	newRootInfo, err := fs.Stat(newSide.fsys, root)
+	if err != nil {
+		return false, fmt.Errorf("cannot open file '%s': error %s", root, err)
+	}
+
+	var stack = []diffPair{
+		{
+			fileMetadata: FileMetadata{
+				Path:            root,
+				Name:            rootName,
+				Depth:           0,
+				UseVerticalLine: []bool{},
+			},
+			oldInfo: oldRootInfo,
+			newInfo: newRootInfo,
+		},
+	}
+	var hasDifferences = false
+
+	for len(stack) != 0 {
+		var pair = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var fileMetadata = pair.fileMetadata
+
+		oldTarget, err := oldSide.linkTarget(fileMetadata.Path, pair.oldInfo)
+		if err != nil {
+			return false, err
+		}
+		newTarget, err := newSide.linkTarget(fileMetadata.Path, pair.newInfo)
+		if err != nil {
+			return false, err
+		}
+
+		var currentInfo, currentTarget = pair.newInfo, newTarget
+		if currentInfo == nil {
+			currentInfo, currentTarget = pair.oldInfo, oldTarget
+		}
+
+		fileMetadata.Status = diffStatus(pair.oldInfo, pair.newInfo, oldTarget, newTarget)
+		fileMetadata.IsDir = currentInfo.IsDir()
+		fileMetadata.Mode = currentInfo.Mode()
+		fileMetadata.ModTime = currentInfo.ModTime()
+		fileMetadata.LinkTarget = currentTarget
+		if !fileMetadata.IsDir {
+			fileMetadata.Size = currentInfo.Size()
+		}
+		if fileMetadata.Status == diffStatusChanged && !pair.oldInfo.IsDir() {
+			fileMetadata.PreviousSize = pair.oldInfo.Size()
+		}
+		if fileMetadata.Status != "" {
+			hasDifferences = true
+		}
+
+		oldChildren, err := oldSide.children(fileMetadata.Path, pair.oldInfo)
+		if err != nil {
+			return false, err
+		}
+		newChildren, err := newSide.children(fileMetadata.Path, pair.newInfo)
+		if err != nil {
+			return false, err
+		}
+
+		var names = make([]string, 0, len(oldChildren)+len(newChildren))
+		for name := range oldChildren {
+			names = append(names, name)
+		}
+		for name := range newChildren {
+			if _, ok := oldChildren[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+
+		var childPairs = mapped(&names, func(i int, name string) diffPair {
+			return diffPair{
+				fileMetadata: FileMetadata{
+					Path:  path.Join(fileMetadata.Path, name),
+					Name:  name,
+					Depth: fileMetadata.Depth + 1,
+					UseVerticalLine: append(
+						copied(&fileMetadata.UseVerticalLine),
+						i != len(names)-1,
+					),
+				},
+				oldInfo: oldChildren[name],
+				newInfo: newChildren[name],
+			}
+		})
+		slices.Reverse(childPairs)
+		stack = append(stack, childPairs...)
+
+		err = visit(fileMetadata)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return hasDifferences, nil
+}
+
+// dirTreeDiff prints the merged tree of oldRoot and newRoot and reports whether they differ.
+func dirTreeDiff(out io.Writer, oldRoot string, newRoot string, options TreeOptions) (bool, error) {
+	var renderer, err = newRenderer(out, options)
+	if err != nil {
+		return false, err
+	}
+
+	oldFS, oldCloser, err := openTreeFS(oldRoot)
+	if err != nil {
+		return false, err
+	}
+	defer oldCloser.Close()
+
+	newFS, newCloser, err := openTreeFS(newRoot)
+	if err != nil {
+		return false, err
+	}
+	defer newCloser.Close()
+
+	oldSide, err := newDiffSide(oldFS, options)
+	if err != nil {
+		return false, err
+	}
+	defer oldSide.reader.close()
+
+	newSide, err := newDiffSide(newFS, options)
+	if err != nil {
+		return false, err
+	}
+	defer newSide.reader.close()
+
+	hasDifferences, err := walkDiff(oldSide, newSide, filepath.Base(newRoot), renderer.Render)
+	if err != nil {
+		return false, err
+	}
+
+	return hasDifferences, renderer.Flush()
+}
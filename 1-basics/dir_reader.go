@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/fs"
+	"runtime"
+	"sync"
+)
+
+type dirListing struct {
+	entries []fs.DirEntry
+	err     error
+}
+
+type dirReadJob struct {
+	path   string
+	result chan dirListing
+}
+
+// dirReader lists directories on a bounded pool of workers.
+// The walk prefetches every subdirectory as soon as its parent is read
+// and later collects the listings one by one in its own order,
+// so the output does not depend on which worker finishes first.
+// prefetch and read must be called from a single goroutine.
+type dirReader struct {
+	jobs      chan dirReadJob
+	pending   map[string]chan dirListing
+	waitGroup *sync.WaitGroup
+}
+
+func newDirReader(fsys fs.FS, workers int) *dirReader {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var reader = &dirReader{
+		jobs:      make(chan dirReadJob, workers*16),
+		pending:   map[string]chan dirListing{},
+		waitGroup: &sync.WaitGroup{},
+	}
+
+	for range workers {
+		reader.waitGroup.Add(1)
+
+		go func() {
+			defer reader.waitGroup.Done()
+
+			for job := range reader.jobs {
+				job.result <- readDirWithInfo(fsys, job.path)
+			}
+		}()
+	}
+
+	return reader
+}
+
+// readDirWithInfo also lstats every entry, on network filesystems
+// that is as slow as the listing itself and is worth doing on the worker.
+func readDirWithInfo(fsys fs.FS, dirPath string) dirListing {
+	var entries, err = fs.ReadDir(fsys, dirPath)
+	if err != nil {
+		return dirListing{err: err}
+	}
+
+	for i, entry := range entries {
+		var info, err = entry.Info()
+		if err == nil {
+			entries[i] = fs.FileInfoToDirEntry(info)
+		}
+	}
+
+	return dirListing{entries: entries}
+}
+
+func (r *dirReader) prefetch(dirPath string) {
+	if _, ok := r.pending[dirPath]; ok {
+		return
+	}
+
+	var result = make(chan dirListing, 1)
+	r.pending[dirPath] = result
+	r.jobs <- dirReadJob{path: dirPath, result: result}
+}
+
+func (r *dirReader) read(dirPath string) ([]fs.DirEntry, error) {
+	r.prefetch(dirPath)
+
+	var listing = <-r.pending[dirPath]
+	delete(r.pending, dirPath)
+
+	return listing.entries, listing.err
+}
+
+// close stops the workers, listings that were prefetched but never read are dropped.
+func (r *dirReader) close() {
+	close(r.jobs)
+	r.waitGroup.Wait()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const gitIgnoreFileName = ".gitignore"
+
+// patternsFlag collects repeatable command line flags such as --include.
+type patternsFlag []string
+
+func (p *patternsFlag) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternsFlag) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// entryFilter decides which children of a directory take part in the walk.
+type entryFilter struct {
+	fsys       fs.FS
+	root       string
+	printFiles bool
+	follow     bool
+	include    []string
+	exclude    []string
+	gitIgnore  *gitIgnoreMatcher
+}
+
+func newEntryFilter(fsys fs.FS, root string, options TreeOptions) (*entryFilter, error) {
+	for _, pattern := range append(copied(&options.Include), options.Exclude...) {
+		var _, err = path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob pattern '%s': %w", pattern, err)
+		}
+	}
+
+	var filter = &entryFilter{
+		fsys:       fsys,
+		root:       root,
+		printFiles: options.PrintFiles,
+		follow:     options.Follow,
+		include:    options.Include,
+		exclude:    options.Exclude,
+	}
+	if options.GitIgnore {
+		filter.gitIgnore = &gitIgnoreMatcher{fsys: fsys, rules: map[string][]gitIgnoreRule{}}
+	}
+	return filter, nil
+}
+
+func (f *entryFilter) relativePath(fullPath string) string {
+	if fullPath == f.root {
+		return ""
+	}
+	return strings.TrimPrefix(fullPath, f.root+"/")
+}
+
+// enterDir must be called before the children of dirPath are filtered,
+// so that its .gitignore rules are in effect for them.
+func (f *entryFilter) enterDir(dirPath string) error {
+	if f.gitIgnore == nil {
+		return nil
+	}
+	return f.gitIgnore.load(dirPath, f.relativePath(dirPath))
+}
+
+func (f *entryFilter) accepts(dirPath string, entry fs.DirEntry) bool {
+	if !f.isDir(dirPath, entry) && !f.printFiles {
+		return false
+	}
+	return f.matches(dirPath, entry)
+}
+
+// isDir treats symlinks to directories as directories when they are going to be followed.
+func (f *entryFilter) isDir(dirPath string, entry fs.DirEntry) bool {
+	if entry.IsDir() {
+		return true
+	}
+	if !f.follow || entry.Type()&fs.ModeSymlink == 0 {
+		return false
+	}
+
+	var targetInfo, err = fs.Stat(f.fsys, path.Join(dirPath, entry.Name()))
+	return err == nil && targetInfo.IsDir()
+}
+
+// matches applies include, exclude and .gitignore rules without looking at the -f flag,
+// directory size roll-ups count files even when they are not printed.
+func (f *entryFilter) matches(dirPath string, entry fs.DirEntry) bool {
+	var relativePath = f.relativePath(path.Join(dirPath, entry.Name()))
+	var isDir = f.isDir(dirPath, entry)
+
+	if matchesAny(f.exclude, entry.Name(), relativePath) {
+		return false
+	}
+	if !isDir && len(f.include) != 0 && !matchesAny(f.include, entry.Name(), relativePath) {
+		return false
+	}
+	if f.gitIgnore != nil && f.gitIgnore.ignored(relativePath, isDir) {
+		return false
+	}
+	return true
+}
+
+// matchesAny reports whether a pattern matches either the entry name or its path relative to root.
+func matchesAny(patterns []string, name string, relativePath string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, relativePath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type gitIgnoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func parseGitIgnore(content string) []gitIgnoreRule {
+	var rules = make([]gitIgnoreRule, 0)
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule gitIgnoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		// a slash anywhere but at the end anchors the pattern to the .gitignore directory
+		rule.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		rule.segments = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+func (r gitIgnoreRule) matches(relativePath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	var parts = strings.Split(relativePath, "/")
+	if !r.anchored {
+		parts = parts[len(parts)-1:]
+	}
+	return matchSegments(r.segments, parts)
+}
+
+func matchSegments(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(parts); skip++ {
+			if matchSegments(pattern[1:], parts[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
+
+// gitIgnoreMatcher keeps the rules of every .gitignore seen during the walk,
+// keyed by the directory (relative to root) that contains it.
+type gitIgnoreMatcher struct {
+	fsys  fs.FS
+	rules map[string][]gitIgnoreRule
+}
+
+func (m *gitIgnoreMatcher) load(dirPath string, relativeDir string) error {
+	var content, err = fs.ReadFile(m.fsys, path.Join(dirPath, gitIgnoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read '%s' in '%s', error %s", gitIgnoreFileName, dirPath, err)
+	}
+
+	m.rules[relativeDir] = parseGitIgnore(string(content))
+	return nil
+}
+
+// ignored applies rules from the outermost .gitignore to the innermost one,
+// the last matching rule wins just like in git.
+func (m *gitIgnoreMatcher) ignored(relativePath string, isDir bool) bool {
+	if path.Base(relativePath) == ".git" && isDir {
+		return true
+	}
+
+	var ignored = false
+	var parts = strings.Split(relativePath, "/")
+
+	for i := range parts {
+		var dir = strings.Join(parts[:i], "/")
+		for _, rule := range m.rules[dir] {
+			if rule.matches(strings.Join(parts[i:], "/"), isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
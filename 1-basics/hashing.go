@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+func hashFile(fsys fs.FS, filePath string) (string, error) {
+	var file, err = fsys.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file '%s', error %s", filePath, err)
+	}
+	defer file.Close()
+
+	var hash = sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash file '%s', error %s", filePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type duplicateGroup struct {
+	Hash  string   `json:"sha256"`
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths"`
+}
+
+func (g duplicateGroup) wasted() int64 {
+	return g.Size * int64(len(g.Paths)-1)
+}
+
+// findDuplicates only hashes files whose size matches another file,
+// a unique size already proves the content is unique.
+func findDuplicates(fsys fs.FS, files []FileMetadata) ([]duplicateGroup, error) {
+	var bySize = map[int64][]FileMetadata{}
+	for _, file := range files {
+		bySize[file.Size] = append(bySize[file.Size], file)
+	}
+
+	var byHash = map[string]*duplicateGroup{}
+	for size, candidates := range bySize {
+		if len(candidates) < 2 {
+			continue
+		}
+
+		for _, candidate := range candidates {
+			var hash, err = hashFile(fsys, candidate.Path)
+			if err != nil {
+				return nil, err
+			}
+
+			var group, ok = byHash[hash]
+			if !ok {
+				group = &duplicateGroup{Hash: hash, Size: size}
+				byHash[hash] = group
+			}
+			group.Paths = append(group.Paths, candidate.Path)
+		}
+	}
+
+	var groups = make([]duplicateGroup, 0)
+	for _, group := range byHash {
+		if len(group.Paths) < 2 {
+			continue
+		}
+		slices.Sort(group.Paths)
+		groups = append(groups, *group)
+	}
+
+	slices.SortFunc(groups, func(a, b duplicateGroup) int {
+		return cmp.Or(
+			cmp.Compare(b.wasted(), a.wasted()),
+			strings.Compare(a.Hash, b.Hash),
+		)
+	})
+	return groups, nil
+}
+
+// reportDuplicates replaces the tree with a list of files sharing the same content.
+// Empty files and symlinks are not reported.
+func reportDuplicates(out io.Writer, fsys fs.FS, options TreeOptions) error {
+	options.PrintFiles = true
+	options.Hash = false
+
+	var files = make([]FileMetadata, 0)
+	var err = walkTree(fsys, ".", options, func(fileMetadata FileMetadata) error {
+		if !fileMetadata.IsDir && fileMetadata.LinkTarget == "" && fileMetadata.Size > 0 {
+			files = append(files, fileMetadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	groups, err := findDuplicates(fsys, files)
+	if err != nil {
+		return err
+	}
+
+	switch options.Format {
+	case "", formatText:
+		return writeDuplicatesText(out, groups, options.HumanReadable)
+	case formatJSON:
+		var encoder = json.NewEncoder(out)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(groups)
+	default:
+		return fmt.Errorf("duplicates report does not support format '%s'", options.Format)
+	}
+}
+
+func writeDuplicatesText(out io.Writer, groups []duplicateGroup, humanReadable bool) error {
+	var report = strings.Builder{}
+	var wasted int64
+
+	for _, group := range groups {
+		fmt.Fprintf(
+			&report,
+			"%d files, %s each, sha256:%s\n",
+			len(group.Paths),
+			formatSize(group.Size, humanReadable),
+			group.Hash,
+		)
+		for _, filePath := range group.Paths {
+			fmt.Fprintf(&report, "\t%s\n", filePath)
+		}
+		wasted += group.wasted()
+	}
+	fmt.Fprintf(&report, "%d duplicate groups, %s reclaimable\n", len(groups), formatSize(wasted, humanReadable))
+
+	var _, err = io.WriteString(out, report.String())
+	if err != nil {
+		return fmt.Errorf("failed to write '%s' to output stream", report.String())
+	}
+	return nil
+}
@@ -1,27 +1,66 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"slices"
-	"sort"
-	"strconv"
 	"strings"
+	"time"
 )
 
 type FileMetadata struct {
 	fmt.Stringer
 
 	Path            string
+	Name            string
+	IsDir           bool
+	Size            int64
+	Mode            fs.FileMode
+	ModTime         time.Time
+	Owner           string
+	Hash            string
+	LinkTarget      string
+	Recursive       bool
+	Truncated       bool
+	Status          string
+	PreviousSize    int64
 	Depth           int
 	UseVerticalLine []bool
+
+	fileInfo  fs.FileInfo
+	ancestors []fs.FileInfo
 }
 
 func (f *FileMetadata) String() string {
 	return fmt.Sprintf("{%s}", f.Path)
 }
 
+type TreeOptions struct {
+	PrintFiles    bool
+	Format        string
+	Include       []string
+	Exclude       []string
+	GitIgnore     bool
+	MaxDepth      int
+	DirSizes      bool
+	HumanReadable bool
+	Follow        bool
+	Workers       int
+	Sort          string
+	Reverse       bool
+	Columns       []string
+	Hash          bool
+	Duplicates    bool
+	Watch         bool
+	Poll          bool
+	PollInterval  time.Duration
+}
+
 func getTreePrefix(
 	depth int,
 	lineStartSymbol string,
@@ -49,31 +88,40 @@ func getTreePrefix(
 }
 
 func handleDir(
-	isRootFile bool,
-	printFiles bool,
-	lineStartSymbol string,
-	fileMetadata FileMetadata,
-	fileInfo os.FileInfo,
+	entryFilter *entryFilter,
+	reader *dirReader,
+	compare entryComparator,
+	maxDepth int,
+	fileMetadata *FileMetadata,
 	stack *[]FileMetadata,
-) (string, error) {
-	var file, err = os.Open(fileMetadata.Path)
+) error {
+	var children, err = reader.read(fileMetadata.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open file '%s', error %s", fileMetadata.Path, err)
+	}
+
+	err = entryFilter.enterDir(fileMetadata.Path)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file '%s', error %s", fileMetadata.Path, err)
+		return err
 	}
 
-	var children, _ = file.ReadDir(0)
-	var childrenFiltered = filter(&children, func(item os.DirEntry) bool {
-		return item.IsDir() || printFiles
+	var childrenFiltered = filter(&children, func(item fs.DirEntry) bool {
+		return entryFilter.accepts(fileMetadata.Path, item)
 	})
 
-	sort.Slice(
+	if maxDepth > 0 && fileMetadata.Depth >= maxDepth {
+		fileMetadata.Truncated = len(childrenFiltered) != 0
+		return nil
+	}
+
+	slices.SortFunc(
 		childrenFiltered,
-		func(i, j int) bool {
-			return childrenFiltered[i].Name() < childrenFiltered[j].Name()
+		func(a, b fs.DirEntry) int {
+			return compare(fileMetadata.Path, a, b)
 		},
 	)
 
-	var childrenMetadata = mapped(&childrenFiltered, func(i int, child os.DirEntry) FileMetadata {
+	var childrenMetadata = mapped(&childrenFiltered, func(i int, child fs.DirEntry) FileMetadata {
 		var useVerticalLineForThisChild = i != len(childrenFiltered)-1
 
 		var newUseVerticalLine = append(
@@ -81,61 +129,65 @@ func handleDir(
 			useVerticalLineForThisChild,
 		)
 
+		var childPath = path.Join(fileMetadata.Path, child.Name())
+		if entryFilter.isDir(fileMetadata.Path, child) {
+			reader.prefetch(childPath)
+		}
+
+		var childInfo, _ = child.Info()
+
 		return FileMetadata{
-			Path:            fmt.Sprintf("%s/%s", fileMetadata.Path, child.Name()),
+			Path:            childPath,
 			Depth:           fileMetadata.Depth + 1,
 			UseVerticalLine: newUseVerticalLine,
+			fileInfo:        childInfo,
+			ancestors:       fileMetadata.ancestors,
 		}
 	})
 
-	*stack = append(childrenMetadata, *stack...)
-
-	var printString string
-	if !isRootFile {
-		printString = fmt.Sprintf(
-			"%s%s\n",
-			getTreePrefix(
-				fileMetadata.Depth,
-				lineStartSymbol,
-				fileMetadata.UseVerticalLine,
-			),
-			fileInfo.Name(),
-		)
-	}
-	return printString, nil
+	// the top of the stack is its last element, so the first child goes last
+	slices.Reverse(childrenMetadata)
+	*stack = append(*stack, childrenMetadata...)
+
+	return nil
 }
 
-func handleRegularFile(
-	isRootFile bool,
-	lineStartSymbol string,
-	fileInfo os.FileInfo,
-	fileMetadata FileMetadata,
-) string {
-	var size = fileInfo.Size()
-	var sizeStr string
-	if size == 0 {
-		sizeStr = "empty"
-	} else {
-		sizeStr = fmt.Sprintf("%sb", strconv.Itoa(int(size)))
-	}
-
-	var printString string
-	if !isRootFile {
-		printString = fmt.Sprintf(
-			"%s%s (%s)\n",
-			getTreePrefix(
-				fileMetadata.Depth,
-				lineStartSymbol,
-				fileMetadata.UseVerticalLine,
-			),
-			fileInfo.Name(),
-			sizeStr,
-		)
+// walkTree visits the whole fsys in depth-first order, siblings sorted by options.Sort.
+// Root itself is reported with Depth 0 under rootName, so renderers can decide whether to show it.
+func walkTree(
+	fsys fs.FS,
+	rootName string,
+	options TreeOptions,
+	visit func(fileMetadata FileMetadata) error,
+) error {
+	const root = "."
+
+	var entryFilter, err = newEntryFilter(fsys, root, options)
+	if err != nil {
+		return err
+	}
+
+	var reader = newDirReader(fsys, options.Workers)
+	defer reader.close()
+
+	var dirSizes = map[string]int64{}
+	if options.DirSizes {
+		var rootInfo, err = fs.Stat(fsys, root)
+		if err == nil && rootInfo.IsDir() {
+			_, err = collectDirSizes(
+				fsys, root, []fs.FileInfo{rootInfo}, options.Follow, entryFilter, reader, dirSizes,
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	compare, err := newEntryComparator(options.Sort, options.Reverse, dirSizes)
+	if err != nil {
+		return err
 	}
-	return printString
-}
 
-func dirTree(out io.Writer, root string, printFiles bool) error {
 	var stack = []FileMetadata{
 		{
 			Path:            root,
@@ -143,73 +195,205 @@ func dirTree(out io.Writer, root string, printFiles bool) error {
 			UseVerticalLine: []bool{},
 		},
 	}
-	var isRootFile = true
 
 	for len(stack) != 0 {
-		var fileMetadata = stack[0]
+		var fileMetadata = stack[len(stack)-1]
 
-		stack = slices.Delete(stack, 0, 1)
+		stack = stack[:len(stack)-1]
 
-		var fileInfo, err = os.Lstat(fileMetadata.Path)
+		var fileInfo = fileMetadata.fileInfo
+		if fileInfo == nil {
+			fileInfo, err = fs.Lstat(fsys, fileMetadata.Path)
+		}
 
 		if err != nil {
 			return fmt.Errorf("cannot open file '%s': error %s", fileMetadata.Path, err)
 		}
 
-		var printString string
+		fileMetadata.Name = fileInfo.Name()
+		if fileMetadata.Depth == 0 {
+			fileMetadata.Name = rootName
+		}
 
-		var lineStartSymbol = "├"
-		if !isRootFile && (len(stack) == 0 || stack[0].Depth != fileMetadata.Depth) {
-			lineStartSymbol = "└"
+		if fileInfo.Mode()&fs.ModeSymlink != 0 {
+			fileMetadata.LinkTarget, err = fs.ReadLink(fsys, fileMetadata.Path)
+			if _, ok := fsys.(fs.ReadLinkFS); err != nil && !ok {
+				// the file system cannot tell where its links point, they are shown without a target
+				err = nil
+			}
+			if err != nil {
+				return fmt.Errorf("cannot read link '%s': error %s", fileMetadata.Path, err)
+			}
+
+			if options.Follow {
+				// broken links stay as they are and are printed like files
+				var targetInfo, err = fs.Stat(fsys, fileMetadata.Path)
+				if err == nil {
+					fileInfo = targetInfo
+				}
+			}
+		}
+
+		fileMetadata.Mode = fileInfo.Mode()
+		fileMetadata.ModTime = fileInfo.ModTime()
+		if slices.Contains(options.Columns, columnOwner) {
+			fileMetadata.Owner = entryOwner(fileInfo)
 		}
 
 		switch mode := fileInfo.Mode(); {
 		case mode.IsDir():
-			printString, err = handleDir(
-				isRootFile,
-				printFiles,
-				lineStartSymbol,
-				fileMetadata,
-				fileInfo,
-				&stack,
-			)
+			fileMetadata.IsDir = true
+			fileMetadata.Size = dirSizes[fileMetadata.Path]
+
+			if isAncestor(fileMetadata.ancestors, fileInfo) {
+				fileMetadata.Recursive = true
+				break
+			}
+			fileMetadata.ancestors = append(copied(&fileMetadata.ancestors), fileInfo)
+
+			err = handleDir(entryFilter, reader, compare, options.MaxDepth, &fileMetadata, &stack)
 			if err != nil {
 				return err
 			}
 
-		case mode.IsRegular() && printFiles:
-			printString = handleRegularFile(
-				isRootFile,
-				lineStartSymbol,
-				fileInfo,
-				fileMetadata,
-			)
-		}
+		case mode.IsRegular() && options.PrintFiles:
+			fileMetadata.Size = fileInfo.Size()
 
-		if len(printString) != 0 {
-			var _, err = out.Write([]byte(printString))
-			if err != nil {
-				return fmt.Errorf("failed to write '%s' to output stream", printString)
+			if options.Hash {
+				fileMetadata.Hash, err = hashFile(fsys, fileMetadata.Path)
+				if err != nil {
+					return err
+				}
 			}
+
+		case mode&fs.ModeSymlink != 0 && options.PrintFiles:
+
+		default:
+			continue
 		}
 
-		isRootFile = false
+		err = visit(fileMetadata)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// isAncestor tells whether info is one of the directories above the current one.
+// os.SameFile compares device and inode, so a link back to an ancestor is caught
+// however it was reached. Entries of archives never match and are not followed anyway.
+func isAncestor(ancestors []fs.FileInfo, info fs.FileInfo) bool {
+	return slices.ContainsFunc(ancestors, func(ancestor fs.FileInfo) bool {
+		return os.SameFile(ancestor, info)
+	})
+}
+
+// dirTreeFS prints any file system, e.g. an embed.FS or an opened archive.
+func dirTreeFS(out io.Writer, fsys fs.FS, rootName string, options TreeOptions) error {
+	if options.Duplicates {
+		return reportDuplicates(out, fsys, options)
+	}
+
+	var renderer, err = newRenderer(out, options)
+	if err != nil {
+		return err
+	}
+
+	err = walkTree(fsys, rootName, options, renderer.Render)
+	if err != nil {
+		return err
+	}
+
+	return renderer.Flush()
+}
+
+// dirTreeWithOptions prints a directory or, if root is a zip or tar file, the archive contents.
+func dirTreeWithOptions(out io.Writer, root string, options TreeOptions) error {
+	var fsys, closer, err = openTreeFS(root)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	return dirTreeFS(out, fsys, filepath.Base(root), options)
+}
+
+func dirTree(out io.Writer, root string, printFiles bool) error {
+	return dirTreeWithOptions(out, root, TreeOptions{
+		PrintFiles: printFiles,
+		Format:     formatText,
+	})
+}
+
+// parseArgs splits leading positional arguments (a root, or "diff" with two roots) from flags.
+func parseArgs(args []string) ([]string, TreeOptions, error) {
+	var options TreeOptions
+
+	var positional = 0
+	for positional < len(args) && !strings.HasPrefix(args[positional], "-") {
+		positional++
+	}
+
+	var isDiff = positional == 3 && args[0] == "diff"
+	if positional != 1 && !isDiff {
+		return nil, options, fmt.Errorf("expected a root path or diff with two roots")
+	}
+
+	var flagSet = flag.NewFlagSet("tree", flag.ContinueOnError)
+	flagSet.BoolVar(&options.PrintFiles, "f", false, "print files")
+	flagSet.StringVar(&options.Format, "format", formatText, "output format: text|json|xml|html")
+	flagSet.Var((*patternsFlag)(&options.Include), "include", "glob of files to show, repeatable")
+	flagSet.Var((*patternsFlag)(&options.Exclude), "exclude", "glob of files and directories to skip, repeatable")
+	flagSet.BoolVar(&options.GitIgnore, "gitignore", false, "honour .gitignore files found while walking")
+	flagSet.IntVar(&options.MaxDepth, "L", 0, "descend only this many levels, 0 means unlimited")
+	flagSet.BoolVar(&options.DirSizes, "du", false, "show the total size of every directory")
+	flagSet.BoolVar(&options.HumanReadable, "h", false, "print sizes in KiB, MiB, ...")
+	flagSet.BoolVar(&options.Follow, "follow", false, "descend into symlinked directories")
+	flagSet.StringVar(&options.Sort, "sort", sortByName, "order of siblings: name|size|mtime|ext")
+	flagSet.BoolVar(&options.Reverse, "reverse", false, "reverse the sort order")
+	flagSet.Var((*columnsFlag)(&options.Columns), "columns", "metadata appended to each line: perm,owner,mtime")
+	flagSet.BoolVar(&options.Hash, "hash", false, "show the SHA-256 of every file")
+	flagSet.BoolVar(&options.Duplicates, "duplicates", false, "list files with identical content instead of the tree")
+	flagSet.BoolVar(&options.Watch, "watch", false, "keep running and print the tree again when it changes")
+	flagSet.BoolVar(&options.Poll, "poll", false, "watch by polling instead of inotify, e.g. on network filesystems")
+	flagSet.DurationVar(&options.PollInterval, "interval", defaultPollInterval, "how often to poll in watch mode")
+	flagSet.IntVar(&options.Workers, "workers", 0, "number of directories read in parallel, defaults to the number of CPUs")
+
+	var err = flagSet.Parse(args[positional:])
+	if err != nil {
+		return nil, options, err
+	}
+
+	return args[:positional], options, nil
+}
+
 func main() {
 	out := os.Stdout
 
-	if !(len(os.Args) == 2 || len(os.Args) == 3) {
-		panic("usage go run main.go . [-f]")
+	paths, options, err := parseArgs(os.Args[1:])
+	if err != nil {
+		panic("usage go run main.go [diff old] . [-f] [--format=text|json|xml|html] [--include=glob] [--exclude=glob] [--gitignore] [-L depth] [--du] [-h] [--follow] [--workers=n] [--sort=name|size|mtime|ext] [--reverse] [--columns=perm,owner,mtime] [--hash] [--duplicates] [--watch [--poll] [--interval=1s]]")
 	}
 
-	path := os.Args[1]
-	shouldPrintFiles := len(os.Args) == 3 && os.Args[2] == "-f"
+	if len(paths) == 3 {
+		hasDifferences, err := dirTreeDiff(out, paths[1], paths[2], options)
+		if err != nil {
+			panic(err.Error())
+		}
+		// same convention as diff(1): 0 when equal, 1 when there are differences
+		if hasDifferences {
+			os.Exit(1)
+		}
+		return
+	}
 
-	err := dirTree(out, path, shouldPrintFiles)
+	if options.Watch {
+		err = watchTree(out, paths[0], options, nil)
+	} else {
+		err = dirTreeWithOptions(out, paths[0], options)
+	}
 
 	if err != nil {
 		panic(err.Error())
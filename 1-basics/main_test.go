@@ -1,10 +1,23 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"embed"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+//go:embed testdata
+var testdataFS embed.FS
+
 const testFullResult = `├───project
 │	├───file.txt (19b)
 │	└───gopher.png (70372b)
@@ -73,3 +86,514 @@ func TestTreeDir(t *testing.T) {
 		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDirResult)
 	}
 }
+
+const testJSONResult = `{
+	"name": "ipsum",
+	"type": "directory",
+	"children": [
+		{
+			"name": "gopher.png",
+			"type": "file",
+			"size": 70372
+		}
+	]
+}
+`
+
+func TestTreeJSON(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/zline/lorem/ipsum", TreeOptions{PrintFiles: true, Format: formatJSON})
+	if err != nil {
+		t.Errorf("test for OK Failed - error")
+	}
+	result := out.String()
+	if result != testJSONResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testJSONResult)
+	}
+}
+
+const testFilteredResult = `├───.gitignore (14b)
+├───docs
+│	└───readme.md (empty)
+└───src
+	├───.gitignore (10b)
+	├───keep.log (empty)
+	└───main.go (empty)
+`
+
+func TestTreeFiltered(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":      "*.log\n/build/\n",
+		"build/out.bin":   "",
+		"docs/readme.md":  "",
+		"docs/notes.txt":  "",
+		"src/.gitignore":  "!keep.log\n",
+		"src/keep.log":    "",
+		"src/main.go":     "",
+		"src/debug.log":   "",
+		"vendor/lib/a.go": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, root, TreeOptions{
+		PrintFiles: true,
+		Exclude:    []string{"vendor", "*.txt"},
+		GitIgnore:  true,
+	})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testFilteredResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFilteredResult)
+	}
+}
+
+const testDepthSizesResult = `├───project (68.7KiB)
+├───static (275.0KiB)
+│	└───…
+└───zline (137.4KiB)
+	└───…
+`
+
+func TestTreeDepthSizes(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata", TreeOptions{MaxDepth: 1, DirSizes: true, HumanReadable: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testDepthSizesResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDepthSizesResult)
+	}
+}
+
+const testSymlinksResult = `├───data
+│	├───file.txt (2b)
+│	└───loop -> .. [recursive, not followed]
+├───file-link -> data/file.txt
+└───missing -> nowhere
+`
+
+func TestTreeSymlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "data", "file.txt"), []byte("ok"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"data/loop": "..",
+		"file-link": "data/file.txt",
+		"missing":   "nowhere",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks are not supported: %s", err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, root, TreeOptions{PrintFiles: true, Follow: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testSymlinksResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testSymlinksResult)
+	}
+}
+
+const testFollowSizesResult = `├───data (3b)
+│	└───b (3b)
+└───link -> data
+	└───b (3b)
+`
+
+func TestTreeFollowSizes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "data", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "data", "b", "file.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data", filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks are not supported: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, root, TreeOptions{Follow: true, DirSizes: true, Sort: sortBySize})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testFollowSizesResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFollowSizesResult)
+	}
+}
+
+func TestTreeWorkers(t *testing.T) {
+	for _, workers := range []int{1, 2, 16} {
+		out := new(bytes.Buffer)
+		err := dirTreeWithOptions(out, "testdata", TreeOptions{PrintFiles: true, Workers: workers})
+		if err != nil {
+			t.Errorf("test for OK Failed - error %s", err)
+		}
+		result := out.String()
+		if result != testFullResult {
+			t.Errorf("test for %d workers Failed - results not match\nGot:\n%v\nExpected:\n%v", workers, result, testFullResult)
+		}
+	}
+}
+
+const testSortedResult = `├───ipsum (70372b)
+│	└───gopher.png (70372b)
+├───gopher.png (70372b)
+└───dolor.txt (empty)
+`
+
+func TestTreeSorted(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/static/a_lorem", TreeOptions{
+		PrintFiles: true,
+		DirSizes:   true,
+		Sort:       sortBySize,
+		Reverse:    true,
+	})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testSortedResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testSortedResult)
+	}
+}
+
+func TestTreeEmbedFS(t *testing.T) {
+	fsys, err := fs.Sub(testdataFS, "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	err = dirTreeFS(out, fsys, "testdata", TreeOptions{PrintFiles: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testFullResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFullResult)
+	}
+}
+
+const testTarResult = `└───release
+	├───bin
+	│	└───app (4b)
+	└───link -> bin/app
+`
+
+func TestTreeTarArchive(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "release.tar.gz")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	headers := []*tar.Header{
+		{Name: "release/bin/app", Mode: 0o755, Size: 4, Typeflag: tar.TypeReg},
+		{Name: "release/link", Linkname: "bin/app", Typeflag: tar.TypeSymlink},
+	}
+	for _, header := range headers {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size != 0 {
+			if _, err := tarWriter.Write([]byte("elf!")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, closer := range []interface{ Close() error }{tarWriter, gzipWriter, file} {
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	err = dirTreeWithOptions(out, archivePath, TreeOptions{PrintFiles: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testTarResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testTarResult)
+	}
+
+	fsys, closer, err := openTreeFS(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	content, err := fs.ReadFile(fsys, "release/bin/app")
+	if err != nil || string(content) != "elf!" {
+		t.Errorf("failed to read archive member, got %q, error %v", content, err)
+	}
+}
+
+func TestTreeTarAppended(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "release.tar")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarWriter := tar.NewWriter(file)
+	members := []struct {
+		header  *tar.Header
+		content string
+	}{
+		{&tar.Header{Name: "release/app", Mode: 0o644, Typeflag: tar.TypeReg}, "old"},
+		// tar extracts members in order, a later copy replaces an earlier one
+		{&tar.Header{Name: "release/app", Mode: 0o644, Typeflag: tar.TypeReg}, "newer"},
+		{&tar.Header{Name: "release/", Mode: 0o700, Typeflag: tar.TypeDir}, ""},
+	}
+	for _, member := range members {
+		member.header.Size = int64(len(member.content))
+		if err := tarWriter.WriteHeader(member.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(member.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, closer := range []interface{ Close() error }{tarWriter, file} {
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	err = dirTreeWithOptions(out, archivePath, TreeOptions{PrintFiles: true, Columns: []string{columnPermissions}})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	expected := "└───release [drwx------]\n\t└───app (5b) [-rw-r--r--]\n"
+	if result := out.String(); result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+
+	fsys, closer, err := openTreeFS(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	content, err := fs.ReadFile(fsys, "release/app")
+	if err != nil || string(content) != "newer" {
+		t.Errorf("failed to read the last copy of an archive member, got %q, error %v", content, err)
+	}
+}
+
+func TestTreeZipArchive(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "release.zip")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipWriter := zip.NewWriter(file)
+	members := []struct {
+		name    string
+		mode    fs.FileMode
+		content string
+	}{
+		{"release/bin/app", 0o755, "elf!"},
+		// zip keeps the target of a link as its contents
+		{"release/link", fs.ModeSymlink | 0o777, "bin/app"},
+	}
+	for _, member := range members {
+		header := &zip.FileHeader{Name: member.name}
+		header.SetMode(member.mode)
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(member.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, closer := range []interface{ Close() error }{zipWriter, file} {
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	err = dirTreeWithOptions(out, archivePath, TreeOptions{PrintFiles: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testTarResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testTarResult)
+	}
+}
+
+func TestTreeFileRoot(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/zzfile.txt", TreeOptions{PrintFiles: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	if result := out.String(); result != "" {
+		t.Errorf("test for OK Failed - expected nothing for a file, got:\n%v", result)
+	}
+}
+
+const testDiffResult = `├───~ grown.txt (2b -> 5b)
+├───- old.txt (3b)
+├───same.txt (4b)
+└───+ sub
+	└───+ new.txt (empty)
+`
+
+func TestTreeDiff(t *testing.T) {
+	oldRoot, newRoot := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(oldRoot, "old.txt"):     "old",
+		filepath.Join(oldRoot, "same.txt"):    "same",
+		filepath.Join(oldRoot, "grown.txt"):   "ab",
+		filepath.Join(newRoot, "same.txt"):    "same",
+		filepath.Join(newRoot, "grown.txt"):   "abcde",
+		filepath.Join(newRoot, "sub/new.txt"): "",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	hasDifferences, err := dirTreeDiff(out, oldRoot, newRoot, TreeOptions{PrintFiles: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	if !hasDifferences {
+		t.Errorf("differences were not reported")
+	}
+	result := out.String()
+	if result != testDiffResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDiffResult)
+	}
+
+	hasDifferences, err = dirTreeDiff(new(bytes.Buffer), "testdata", "testdata", TreeOptions{PrintFiles: true})
+	if err != nil || hasDifferences {
+		t.Errorf("identical trees reported as different, error %v", err)
+	}
+}
+
+const testDuplicatesResult = `7 files, 70372b each, sha256:205b66874721e8feec32a0ca3e4f18506f9c1cd093c97054bdba49d4ee12f803
+	project/gopher.png
+	static/a_lorem/gopher.png
+	static/a_lorem/ipsum/gopher.png
+	static/z_lorem/gopher.png
+	static/z_lorem/ipsum/gopher.png
+	zline/lorem/gopher.png
+	zline/lorem/ipsum/gopher.png
+1 duplicate groups, 422232b reclaimable
+`
+
+func TestTreeDuplicates(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata", TreeOptions{Duplicates: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error %s", err)
+	}
+	result := out.String()
+	if result != testDuplicatesResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDuplicatesResult)
+	}
+}
+
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func waitForOutput(t *testing.T, out *syncBuffer, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("watch output not match\nGot:\n%v\nExpected:\n%v", out.String(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTreeWatch(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		out := &syncBuffer{}
+		stop := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- watchTree(out, root, TreeOptions{
+				PrintFiles:   true,
+				Poll:         poll,
+				PollInterval: 20 * time.Millisecond,
+			}, stop)
+		}()
+
+		first := "└───a.txt (1b)\n"
+		waitForOutput(t, out, first)
+
+		if err := os.MkdirAll(filepath.Join(root, "b", "c"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "b", "c", "d.txt"), []byte("dd"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		second := strings.Join([]string{
+			first,
+			"├───a.txt (1b)",
+			"└───b",
+			"\t└───c",
+			"\t\t└───d.txt (2b)",
+			"",
+		}, "\n")
+		waitForOutput(t, out, second)
+
+		close(stop)
+		if err := <-done; err != nil {
+			t.Errorf("watch for poll=%v Failed - error %s", poll, err)
+		}
+	}
+}
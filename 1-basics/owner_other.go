@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func fileOwner(fileInfo os.FileInfo) string {
+	return "?"
+}
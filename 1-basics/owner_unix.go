@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+var ownerNames sync.Map
+
+// fileOwner resolves the owner name once per uid, falling back to the numeric id.
+func fileOwner(fileInfo os.FileInfo) string {
+	var stat, ok = fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "?"
+	}
+
+	var uid = strconv.FormatUint(uint64(stat.Uid), 10)
+	if name, ok := ownerNames.Load(uid); ok {
+		return name.(string)
+	}
+
+	var name = uid
+	if owner, err := user.LookupId(uid); err == nil {
+		name = owner.Username
+	}
+	ownerNames.Store(uid, name)
+
+	return name
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatHTML = "html"
+)
+
+var diffMarkers = map[string]string{
+	diffStatusAdded:   "+ ",
+	diffStatusRemoved: "- ",
+	diffStatusChanged: "~ ",
+}
+
+const (
+	entryTypeDirectory = "directory"
+	entryTypeFile      = "file"
+	entryTypeSymlink   = "symlink"
+)
+
+// TreeRenderer consumes the FileMetadata stream produced by walkTree.
+// Render is called once per entry in traversal order, Flush once after the walk.
+type TreeRenderer interface {
+	Render(fileMetadata FileMetadata) error
+	Flush() error
+}
+
+func newRenderer(out io.Writer, options TreeOptions) (TreeRenderer, error) {
+	var builder = treeBuilder{dirSizes: options.DirSizes, columns: options.Columns}
+
+	switch options.Format {
+	case "", formatText:
+		return &textRenderer{out: out, options: options}, nil
+	case formatJSON:
+		return &jsonRenderer{treeBuilder: builder, out: out}, nil
+	case formatXML:
+		return &xmlRenderer{treeBuilder: builder, out: out}, nil
+	case formatHTML:
+		return &htmlRenderer{
+			treeBuilder: builder,
+			out:         out,
+			template:    newHTMLTreeTemplate(options.HumanReadable),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format '%s'", options.Format)
+	}
+}
+
+type textRenderer struct {
+	out     io.Writer
+	options TreeOptions
+}
+
+func (r *textRenderer) Render(fileMetadata FileMetadata) error {
+	if fileMetadata.Depth == 0 {
+		return nil
+	}
+
+	var lineStartSymbol = "├"
+	if !fileMetadata.UseVerticalLine[fileMetadata.Depth-1] {
+		lineStartSymbol = "└"
+	}
+
+	var printString = fmt.Sprintf(
+		"%s%s",
+		getTreePrefix(
+			fileMetadata.Depth,
+			lineStartSymbol,
+			fileMetadata.UseVerticalLine,
+		),
+		diffMarkers[fileMetadata.Status]+fileMetadata.Name,
+	)
+	var sizeChanged = fileMetadata.Status == diffStatusChanged && fileMetadata.PreviousSize != fileMetadata.Size
+
+	if fileMetadata.LinkTarget != "" {
+		printString = fmt.Sprintf("%s -> %s", printString, fileMetadata.LinkTarget)
+	} else if sizeChanged && !fileMetadata.IsDir {
+		printString = fmt.Sprintf(
+			"%s (%s -> %s)",
+			printString,
+			formatSize(fileMetadata.PreviousSize, r.options.HumanReadable),
+			formatSize(fileMetadata.Size, r.options.HumanReadable),
+		)
+	} else if fileMetadata.Hash != "" {
+		printString = fmt.Sprintf(
+			"%s (%s, sha256:%s)",
+			printString,
+			formatSize(fileMetadata.Size, r.options.HumanReadable),
+			fileMetadata.Hash,
+		)
+	} else if !fileMetadata.IsDir || r.options.DirSizes {
+		printString = fmt.Sprintf(
+			"%s (%s)",
+			printString,
+			formatSize(fileMetadata.Size, r.options.HumanReadable),
+		)
+	}
+	if len(r.options.Columns) != 0 {
+		printString = fmt.Sprintf("%s [%s]", printString, formatColumns(r.options.Columns, fileMetadata))
+	}
+	if fileMetadata.Recursive {
+		printString += " [recursive, not followed]"
+	}
+	printString += "\n"
+
+	if fileMetadata.Truncated {
+		printString += fmt.Sprintf(
+			"%s…\n",
+			getTreePrefix(
+				fileMetadata.Depth+1,
+				"└",
+				append(copied(&fileMetadata.UseVerticalLine), false),
+			),
+		)
+	}
+
+	var _, err = io.WriteString(r.out, printString)
+	if err != nil {
+		return fmt.Errorf("failed to write '%s' to output stream", printString)
+	}
+	return nil
+}
+
+func (r *textRenderer) Flush() error {
+	return nil
+}
+
+type treeNode struct {
+	XMLName   xml.Name    `json:"-" xml:"entry"`
+	Name      string      `json:"name" xml:"name,attr"`
+	Type      string      `json:"type" xml:"type,attr"`
+	Size      *int64      `json:"size,omitempty" xml:"size,attr,omitempty"`
+	Mode      string      `json:"mode,omitempty" xml:"mode,attr,omitempty"`
+	Owner     string      `json:"owner,omitempty" xml:"owner,attr,omitempty"`
+	Modified  string      `json:"modified,omitempty" xml:"modified,attr,omitempty"`
+	Hash      string      `json:"sha256,omitempty" xml:"sha256,attr,omitempty"`
+	Target    string      `json:"target,omitempty" xml:"target,attr,omitempty"`
+	Recursive bool        `json:"recursive,omitempty" xml:"recursive,attr,omitempty"`
+	Truncated bool        `json:"truncated,omitempty" xml:"truncated,attr,omitempty"`
+	Status    string      `json:"status,omitempty" xml:"status,attr,omitempty"`
+	Previous  *int64      `json:"previousSize,omitempty" xml:"previousSize,attr,omitempty"`
+	Children  []*treeNode `json:"children,omitempty" xml:"entry"`
+}
+
+// treeBuilder reassembles the flat traversal stream into nested nodes,
+// relying on the fact that every entry arrives right after its parent's subtree began.
+type treeBuilder struct {
+	dirSizes bool
+	columns  []string
+	root     *treeNode
+	stack    []*treeNode
+}
+
+func (b *treeBuilder) Render(fileMetadata FileMetadata) error {
+	var node = &treeNode{
+		Name:      fileMetadata.Name,
+		Type:      entryTypeDirectory,
+		Hash:      fileMetadata.Hash,
+		Target:    fileMetadata.LinkTarget,
+		Recursive: fileMetadata.Recursive,
+		Truncated: fileMetadata.Truncated,
+		Status:    fileMetadata.Status,
+	}
+	if fileMetadata.Status == diffStatusChanged && !fileMetadata.IsDir {
+		var previousSize = fileMetadata.PreviousSize
+		node.Previous = &previousSize
+	}
+	if !fileMetadata.IsDir {
+		node.Type = entryTypeFile
+	}
+	for _, column := range b.columns {
+		switch column {
+		case columnPermissions:
+			node.Mode = fileMetadata.Mode.String()
+		case columnOwner:
+			node.Owner = fileMetadata.Owner
+		case columnMtime:
+			node.Modified = fileMetadata.ModTime.Format(time.RFC3339)
+		}
+	}
+	if fileMetadata.LinkTarget != "" {
+		node.Type = entryTypeSymlink
+	} else if !fileMetadata.IsDir || b.dirSizes {
+		var size = fileMetadata.Size
+		node.Size = &size
+	}
+
+	if fileMetadata.Depth == 0 {
+		b.root = node
+	} else {
+		var parent = b.stack[fileMetadata.Depth-1]
+		parent.Children = append(parent.Children, node)
+	}
+	b.stack = append(b.stack[:fileMetadata.Depth], node)
+
+	return nil
+}
+
+type jsonRenderer struct {
+	treeBuilder
+	out io.Writer
+}
+
+func (r *jsonRenderer) Flush() error {
+	var encoder = json.NewEncoder(r.out)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(r.root)
+}
+
+type xmlRenderer struct {
+	treeBuilder
+	out io.Writer
+}
+
+func (r *xmlRenderer) Flush() error {
+	var _, err = io.WriteString(r.out, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	var encoder = xml.NewEncoder(r.out)
+	encoder.Indent("", "\t")
+	err = encoder.Encode(r.root)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(r.out, "\n")
+	return err
+}
+
+func newHTMLTreeTemplate(humanReadable bool) *template.Template {
+	return template.Must(
+		template.New("tree").
+			Funcs(template.FuncMap{
+				"formatSize": func(size int64) string {
+					return formatSize(size, humanReadable)
+				},
+			}).
+			Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<ul>
+{{template "node" .}}
+</ul>
+</body>
+</html>
+{{define "node"}}<li class="{{.Type}}{{with .Status}} {{.}}{{end}}">{{.Name}}{{with .Target}} -&gt; {{.}}{{end}}{{with .Size}} ({{formatSize .}}){{end}}{{with .Children}}
+<ul>
+{{range .}}{{template "node" .}}
+{{end}}</ul>
+{{end}}{{if .Truncated}}
+<ul><li>…</li></ul>
+{{end}}</li>{{end}}`),
+	)
+}
+
+type htmlRenderer struct {
+	treeBuilder
+	out      io.Writer
+	template *template.Template
+}
+
+func (r *htmlRenderer) Flush() error {
+	return r.template.Execute(r.out, r.root)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+)
+
+var humanReadableUnits = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+func formatSize(size int64, humanReadable bool) string {
+	if size == 0 {
+		return "empty"
+	}
+	if !humanReadable {
+		return fmt.Sprintf("%sb", strconv.Itoa(int(size)))
+	}
+
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	var value = float64(size)
+	var unitIndex = -1
+	for value >= unit && unitIndex < len(humanReadableUnits)-1 {
+		value /= unit
+		unitIndex++
+	}
+	return fmt.Sprintf("%.1f%s", value, humanReadableUnits[unitIndex])
+}
+
+// collectDirSizes walks dirPath bottom-up and stores the total size of regular files
+// below every directory, including subtrees that are later cut off by the depth limit.
+// With follow, symlinked directories are descended like walkTree does, ancestors guarding against cycles.
+func collectDirSizes(
+	fsys fs.FS,
+	dirPath string,
+	ancestors []fs.FileInfo,
+	follow bool,
+	entryFilter *entryFilter,
+	reader *dirReader,
+	sizes map[string]int64,
+) (int64, error) {
+	var children, err = reader.read(dirPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file '%s', error %s", dirPath, err)
+	}
+
+	err = entryFilter.enterDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+
+	children = filter(&children, func(child fs.DirEntry) bool {
+		return entryFilter.matches(dirPath, child)
+	})
+	for _, child := range children {
+		if child.IsDir() {
+			reader.prefetch(path.Join(dirPath, child.Name()))
+		}
+	}
+
+	var total int64
+	for _, child := range children {
+		var childPath = path.Join(dirPath, child.Name())
+
+		var info, err = child.Info()
+		if err != nil {
+			return 0, fmt.Errorf("cannot open file '%s': error %s", childPath, err)
+		}
+		if follow && info.Mode()&fs.ModeSymlink != 0 {
+			// broken links count as nothing, as they are printed like files
+			if targetInfo, err := fs.Stat(fsys, childPath); err == nil {
+				info = targetInfo
+			}
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if isAncestor(ancestors, info) {
+				continue
+			}
+
+			var size, err = collectDirSizes(
+				fsys, childPath, append(copied(&ancestors), info), follow, entryFilter, reader, sizes,
+			)
+			if err != nil {
+				return 0, err
+			}
+			total += size
+
+		case mode.IsRegular():
+			total += info.Size()
+		}
+	}
+
+	sizes[dirPath] = total
+	return total, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const (
+	sortByName  = "name"
+	sortBySize  = "size"
+	sortByMtime = "mtime"
+	sortByExt   = "ext"
+)
+
+type entryComparator func(dirPath string, a fs.DirEntry, b fs.DirEntry) int
+
+// newEntryComparator orders the children of a directory, ties are always broken by name
+// so the output stays stable. Directory sizes come from the --du roll-ups when they are computed.
+func newEntryComparator(sortMode string, reverse bool, dirSizes map[string]int64) (entryComparator, error) {
+	var byKey func(dirPath string, a fs.DirEntry, b fs.DirEntry) int
+
+	switch sortMode {
+	case "", sortByName:
+		byKey = func(string, fs.DirEntry, fs.DirEntry) int {
+			return 0
+		}
+
+	case sortBySize:
+		var sizeOf = func(dirPath string, entry fs.DirEntry) int64 {
+			if size, ok := dirSizes[path.Join(dirPath, entry.Name())]; ok {
+				return size
+			}
+			var info, err = entry.Info()
+			if err != nil {
+				return 0
+			}
+			return info.Size()
+		}
+		byKey = func(dirPath string, a fs.DirEntry, b fs.DirEntry) int {
+			return cmp.Compare(sizeOf(dirPath, a), sizeOf(dirPath, b))
+		}
+
+	case sortByMtime:
+		byKey = func(dirPath string, a fs.DirEntry, b fs.DirEntry) int {
+			var aInfo, aErr = a.Info()
+			var bInfo, bErr = b.Info()
+			if aErr != nil || bErr != nil {
+				return 0
+			}
+			return aInfo.ModTime().Compare(bInfo.ModTime())
+		}
+
+	case sortByExt:
+		byKey = func(dirPath string, a fs.DirEntry, b fs.DirEntry) int {
+			return strings.Compare(path.Ext(a.Name()), path.Ext(b.Name()))
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown sort mode '%s'", sortMode)
+	}
+
+	return func(dirPath string, a fs.DirEntry, b fs.DirEntry) int {
+		var result = cmp.Or(
+			byKey(dirPath, a, b),
+			strings.Compare(a.Name(), b.Name()),
+		)
+		if reverse {
+			return -result
+		}
+		return result
+	}, nil
+}
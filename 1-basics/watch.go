@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"time"
+)
+
+const (
+	defaultPollInterval = time.Second
+	watchDebounce       = 100 * time.Millisecond
+)
+
+// changeWatcher signals that something under the watched root may have changed.
+// Several changes in a row can be delivered as a single signal.
+type changeWatcher interface {
+	Changes() <-chan struct{}
+	Close() error
+}
+
+type entrySnapshot struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// pollingWatcher compares snapshots of the whole tree, it works for any fs.FS
+// and on filesystems without change notifications, e.g. network mounts.
+type pollingWatcher struct {
+	changes chan struct{}
+	done    chan struct{}
+}
+
+func newPollingWatcher(fsys fs.FS, interval time.Duration) *pollingWatcher {
+	return startPolling(fsys, interval, make(chan struct{}, 1))
+}
+
+// startPolling signals changes on the given channel, which may be shared with another watcher.
+func startPolling(fsys fs.FS, interval time.Duration, changes chan struct{}) *pollingWatcher {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	var watcher = &pollingWatcher{
+		changes: changes,
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		var ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var previous = takeSnapshot(fsys)
+		for {
+			select {
+			case <-watcher.done:
+				return
+			case <-ticker.C:
+			}
+
+			var current = takeSnapshot(fsys)
+			if !maps.Equal(previous, current) {
+				notify(watcher.changes)
+			}
+			previous = current
+		}
+	}()
+
+	return watcher
+}
+
+// takeSnapshot ignores unreadable entries, they show up as changes once they become readable.
+func takeSnapshot(fsys fs.FS) map[string]entrySnapshot {
+	var snapshot = map[string]entrySnapshot{}
+
+	fs.WalkDir(fsys, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		var info, infoErr = entry.Info()
+		if infoErr != nil {
+			return nil
+		}
+		snapshot[filePath] = entrySnapshot{
+			isDir:   entry.IsDir(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+		return nil
+	})
+
+	return snapshot
+}
+
+func (w *pollingWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *pollingWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+// notify never blocks, a pending signal already covers the new change.
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// watchTree prints the tree of root and prints it again every time the output changes,
+// renders are separated by an empty line. It returns when stop is closed.
+func watchTree(out io.Writer, root string, options TreeOptions, stop <-chan struct{}) error {
+	var fsys, closer, err = openTreeFS(root)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	var watcher changeWatcher
+	if options.Poll {
+		watcher = newPollingWatcher(fsys, options.PollInterval)
+	} else {
+		watcher, err = newChangeWatcher(root, fsys, options.PollInterval)
+		if err != nil {
+			return err
+		}
+	}
+	defer watcher.Close()
+
+	var previous []byte
+	for {
+		var buffer = &bytes.Buffer{}
+		err = dirTreeWithOptions(buffer, root, options)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(previous, buffer.Bytes()) {
+			var separator = ""
+			if previous != nil {
+				separator = "\n"
+			}
+
+			_, err = io.WriteString(out, separator+buffer.String())
+			if err != nil {
+				return fmt.Errorf("failed to write '%s' to output stream", buffer.String())
+			}
+			previous = buffer.Bytes()
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-watcher.Changes():
+		}
+
+		// let a burst of events, e.g. a build writing many files, settle into one render
+		var debounce = time.NewTimer(watchDebounce)
+	settle:
+		for {
+			select {
+			case <-stop:
+				debounce.Stop()
+				return nil
+			case <-watcher.Changes():
+				debounce.Reset(watchDebounce)
+			case <-debounce.C:
+				break settle
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotifyWatcher watches every directory below root, directories created later
+// are added as soon as their creation event arrives. When one of them cannot be watched,
+// the rest of the session falls back to polling, so its subtree does not go unnoticed.
+type inotifyWatcher struct {
+	file     *os.File
+	changes  chan struct{}
+	mutex    *sync.Mutex
+	dirs     map[int32]string
+	fsys     fs.FS
+	interval time.Duration
+	poller   *pollingWatcher
+	closed   bool
+}
+
+// newChangeWatcher uses inotify for directories on disk and falls back to polling
+// for archives or when inotify is not available, e.g. out of watch descriptors.
+func newChangeWatcher(root string, fsys fs.FS, interval time.Duration) (changeWatcher, error) {
+	var info, err = os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return newPollingWatcher(fsys, interval), nil
+	}
+
+	watcher, err := newInotifyWatcher(root, fsys, interval)
+	if err != nil {
+		return newPollingWatcher(fsys, interval), nil
+	}
+	return watcher, nil
+}
+
+func newInotifyWatcher(root string, fsys fs.FS, interval time.Duration) (*inotifyWatcher, error) {
+	// a non-blocking descriptor is served by the runtime poller, so Close interrupts a pending Read
+	var fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init inotify, error %s", err)
+	}
+
+	var watcher = &inotifyWatcher{
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		changes:  make(chan struct{}, 1),
+		mutex:    &sync.Mutex{},
+		dirs:     map[int32]string{},
+		fsys:     fsys,
+		interval: interval,
+	}
+
+	err = watcher.addTree(root)
+	if err != nil {
+		watcher.file.Close()
+		return nil, err
+	}
+
+	go watcher.readEvents()
+
+	return watcher, nil
+}
+
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(dirPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// the directory may already be gone again, nothing to watch then
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+
+		var rawConn, connErr = w.file.SyscallConn()
+		if connErr != nil {
+			return connErr
+		}
+
+		var watchDescriptor int
+		var addErr error
+		connErr = rawConn.Control(func(fd uintptr) {
+			watchDescriptor, addErr = syscall.InotifyAddWatch(int(fd), dirPath, inotifyMask)
+		})
+		if connErr != nil {
+			return connErr
+		}
+		if addErr != nil {
+			return fmt.Errorf("failed to watch '%s', error %s", dirPath, addErr)
+		}
+
+		w.mutex.Lock()
+		w.dirs[int32(watchDescriptor)] = dirPath
+		w.mutex.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) readEvents() {
+	var buffer = make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		var n, err = w.file.Read(buffer)
+		if err != nil {
+			// the file was closed
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			var event = buffer[offset:]
+			var watchDescriptor = int32(binary.NativeEndian.Uint32(event[0:4]))
+			var mask = binary.NativeEndian.Uint32(event[4:8])
+			var nameLength = int(binary.NativeEndian.Uint32(event[12:16]))
+			var name = string(bytes.TrimRight(
+				event[syscall.SizeofInotifyEvent:syscall.SizeofInotifyEvent+nameLength],
+				"\x00",
+			))
+			offset += syscall.SizeofInotifyEvent + nameLength
+
+			w.mutex.Lock()
+			var dirPath = w.dirs[watchDescriptor]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, watchDescriptor)
+			}
+			w.mutex.Unlock()
+
+			var isNewDir = mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0
+			if isNewDir && dirPath != "" {
+				var err = w.addTree(filepath.Join(dirPath, name))
+				if err != nil {
+					w.pollInstead()
+				}
+			}
+		}
+
+		notify(w.changes)
+	}
+}
+
+// pollInstead starts polling the whole tree once, its changes are signalled like inotify events.
+func (w *inotifyWatcher) pollInstead() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.poller == nil && !w.closed {
+		w.poller = startPolling(w.fsys, w.interval, w.changes)
+	}
+}
+
+func (w *inotifyWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	w.mutex.Lock()
+	w.closed = true
+	if w.poller != nil {
+		w.poller.Close()
+	}
+	w.mutex.Unlock()
+
+	return w.file.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// newChangeWatcher polls, native change notifications are only implemented for Linux.
+func newChangeWatcher(root string, fsys fs.FS, interval time.Duration) (changeWatcher, error) {
+	return newPollingWatcher(fsys, interval), nil
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
 	"stepikGoWebServices/pipeline"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -58,3 +68,808 @@ func TestByIlya(t *testing.T) {
 		t.Errorf("f3 have not collected inputs, received = %d", received)
 	}
 }
+
+func TestExecutePipelineContextError(t *testing.T) {
+	var failure = errors.New("bad input")
+	var processed uint32
+
+	err := pipeline.ExecutePipelineContext(
+		context.Background(),
+		func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; ; i++ {
+				if err := pipeline.Send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+		},
+		func(ctx context.Context, in, out chan interface{}) error {
+			for val := range in {
+				if val.(int) == 10 {
+					return failure
+				}
+				atomic.AddUint32(&processed, 1)
+			}
+			return nil
+		},
+		pipeline.WithContext(func(in, out chan interface{}) {
+			for range in {
+			}
+		}),
+	)
+
+	if !errors.Is(err, failure) {
+		t.Errorf("error was not propagated\nGot: %v\nExpected: %v", err, failure)
+	}
+	if processed != 10 {
+		t.Errorf("items after the failure were processed, processed = %d", processed)
+	}
+}
+
+func TestExecutePipelineContextPanicAndCancel(t *testing.T) {
+	err := pipeline.ExecutePipelineContext(
+		context.Background(),
+		func(ctx context.Context, in, out chan interface{}) error {
+			panic("overheat")
+		},
+	)
+	if err == nil || !strings.Contains(err.Error(), "overheat") {
+		t.Errorf("panic was not reported, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = pipeline.ExecutePipelineContext(
+		ctx,
+		func(ctx context.Context, in, out chan interface{}) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancellation was not reported, got %v", err)
+	}
+
+	// without jobs there is nothing to run and nothing left behind
+	before := runtime.NumGoroutine()
+	if err := pipeline.ExecutePipelineContext(context.Background()); err != nil {
+		t.Errorf("empty pipeline failed: %s", err)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("empty pipeline leaked %d goroutines", after-before)
+	}
+}
+
+func TestMapPanic(t *testing.T) {
+	transform := func(data int) int {
+		if data == 3 {
+			panic("boom")
+		}
+		return data
+	}
+	inputData := []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+	for _, options := range []pipeline.StageOptions{
+		{},
+		{Workers: 2},
+		{Workers: 2, Ordered: true},
+	} {
+		_, err := pipeline.Run(context.Background(), pipeline.MapWithOptions(transform, options), inputData)
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Errorf("panic was not reported with %+v, got %v", options, err)
+		}
+	}
+
+	err := pipeline.ExecutePipelineContext(
+		context.Background(),
+		pipeline.WithContext(func(in, out chan interface{}) {
+			for _, data := range inputData {
+				out <- data
+			}
+		}),
+		pipeline.Map(transform).ContextJob(),
+	)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("panic was not reported, got %v", err)
+	}
+}
+
+func TestTypedStages(t *testing.T) {
+	fakeMd5 := func(data string) string { return "md5(" + data + ")" }
+	fakeCrc32 := func(data string) string { return "crc32(" + data + ")" }
+	inputData := []int{0, 1, 2}
+
+	var legacyResult interface{}
+	pipeline.ExecutePipeline(
+		Job(func(in, out chan interface{}) {
+			for _, data := range inputData {
+				out <- data
+			}
+		}),
+		Job(func(in, out chan interface{}) {
+			pipeline.SingleHash(in, out, fakeMd5, fakeCrc32)
+		}),
+		Job(func(in, out chan interface{}) {
+			pipeline.MultiHash(in, out, fakeCrc32)
+		}),
+		Job(pipeline.CombineResults),
+		Job(func(in, out chan interface{}) {
+			legacyResult = <-in
+		}),
+	)
+
+	signer := pipeline.Then(
+		pipeline.Then(
+			pipeline.SingleHashStage[int](fakeMd5, fakeCrc32, pipeline.StageOptions{}),
+			pipeline.MultiHashStage(fakeCrc32, pipeline.StageOptions{}),
+		),
+		pipeline.CombineResultsStage(pipeline.StageOptions{}),
+	)
+	results, err := pipeline.Run(context.Background(), signer, inputData)
+	if err != nil {
+		t.Fatalf("typed pipeline failed: %s", err)
+	}
+	if len(results) != 1 || results[0] != legacyResult {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", results, legacyResult)
+	}
+
+	err = pipeline.ExecutePipelineContext(
+		context.Background(),
+		pipeline.WithContext(func(in, out chan interface{}) {
+			out <- "not an int"
+		}),
+		pipeline.SingleHashStage[int](fakeMd5, fakeCrc32, pipeline.StageOptions{}).ContextJob(),
+	)
+	if err == nil || !strings.Contains(err.Error(), "unexpected input") {
+		t.Errorf("type mismatch was not reported, got %v", err)
+	}
+}
+
+func TestBoundedStage(t *testing.T) {
+	var produced, consumed, running, maxRunning int32
+
+	err := pipeline.ExecuteConfiguredPipeline(
+		context.Background(),
+		pipeline.ConfiguredJob{
+			Job: func(ctx context.Context, in, out chan interface{}) error {
+				for i := 0; i < 50; i++ {
+					if err := pipeline.Send(ctx, out, i); err != nil {
+						return err
+					}
+					atomic.AddInt32(&produced, 1)
+				}
+				return nil
+			},
+			Options: pipeline.StageOptions{BufferSize: 1},
+		},
+		pipeline.ConfiguredJob{
+			Job: pipeline.WithContext(func(in, out chan interface{}) {
+				pipeline.PipelineStageWithOptions(in, out, func(data string) string {
+					current := atomic.AddInt32(&running, 1)
+					for {
+						seen := atomic.LoadInt32(&maxRunning)
+						if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt32(&running, -1)
+					return data
+				}, pipeline.StageOptions{Workers: 2})
+			}),
+			Options: pipeline.StageOptions{BufferSize: 1},
+		},
+		pipeline.ConfiguredJob{
+			Job: func(ctx context.Context, in, out chan interface{}) error {
+				for range in {
+					time.Sleep(2 * time.Millisecond)
+					if ahead := atomic.LoadInt32(&produced) - atomic.AddInt32(&consumed, 1); ahead > 6 {
+						return fmt.Errorf("producer is %d items ahead, no backpressure", ahead)
+					}
+				}
+				return nil
+			},
+		},
+	)
+
+	if err != nil {
+		t.Error(err)
+	}
+	if consumed != 50 {
+		t.Errorf("not all items arrived, consumed = %d", consumed)
+	}
+	if maxRunning > 2 {
+		t.Errorf("too many parallel transforms\nGot: %d\nExpected: <=2", maxRunning)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	var produced, consumed, maxAhead int32
+	produce := func() {
+		atomic.AddInt32(&produced, 1)
+	}
+	consume := func() {
+		time.Sleep(time.Millisecond)
+		ahead := atomic.LoadInt32(&produced) - atomic.AddInt32(&consumed, 1)
+		for {
+			seen := atomic.LoadInt32(&maxAhead)
+			if ahead <= seen || atomic.CompareAndSwapInt32(&maxAhead, seen, ahead) {
+				break
+			}
+		}
+	}
+	check := func(name string) {
+		if consumed != 30 {
+			t.Errorf("%s: not all items arrived, consumed = %d", name, consumed)
+		}
+		// one item in the channel, one being consumed and one waiting to be sent
+		if maxAhead > 3 {
+			t.Errorf("%s: producer was %d items ahead, buffer size ignored", name, maxAhead)
+		}
+		produced, consumed, maxAhead = 0, 0, 0
+	}
+
+	pipeline.ExecutePipelineWithOptions(
+		pipeline.StageOptions{BufferSize: 1},
+		Job(func(in, out chan interface{}) {
+			for i := 0; i < 30; i++ {
+				out <- i
+				produce()
+			}
+		}),
+		Job(func(in, out chan interface{}) {
+			for range in {
+				consume()
+			}
+		}),
+	)
+	check("ExecutePipelineWithOptions")
+
+	inputData := make([]int, 30)
+	single := pipeline.StageOptions{Workers: 1}
+	_, err := pipeline.Run(context.Background(), pipeline.ThenWithOptions(
+		pipeline.MapWithOptions(func(data int) int {
+			produce()
+			return data
+		}, single),
+		pipeline.MapWithOptions(func(data int) int {
+			consume()
+			return data
+		}, single),
+		pipeline.StageOptions{BufferSize: 1},
+	), inputData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("ThenWithOptions")
+}
+
+func TestOrderedStage(t *testing.T) {
+	inputData := []int{5, 1, 4, 2, 3, 0}
+	delayedCrc32 := func(data string) string {
+		// later items finish first, so completion order is the reverse of input order
+		delay, _ := strconv.Atoi(data[len(data)-1:])
+		time.Sleep(time.Duration(6-delay) * 5 * time.Millisecond)
+		return data
+	}
+	ordered := pipeline.StageOptions{Ordered: true, Workers: 3}
+
+	signer := pipeline.Then(
+		pipeline.MapWithOptions(func(data int) string { return strconv.Itoa(data) }, ordered),
+		pipeline.Then(
+			pipeline.MultiHashStage(delayedCrc32, ordered),
+			pipeline.CombineResultsStage(ordered),
+		),
+	)
+	results, err := pipeline.Run(context.Background(), signer, inputData)
+	if err != nil {
+		t.Fatalf("ordered pipeline failed: %s", err)
+	}
+
+	// the fake crc32 returns its input, so MultiHash of d is "0d1d2d3d4d5d"
+	parts := make([]string, 0, len(inputData))
+	for _, data := range inputData {
+		var hash string
+		for th := 0; th < 6; th++ {
+			hash += strconv.Itoa(th) + strconv.Itoa(data)
+		}
+		parts = append(parts, hash)
+	}
+	if len(results) != 1 || results[0] != strings.Join(parts, "_") {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", results, strings.Join(parts, "_"))
+	}
+}
+
+func TestStageMetricsAndLogger(t *testing.T) {
+	logs := &bytes.Buffer{}
+	pipeline.SetLogger(slog.New(slog.NewJSONHandler(logs, nil)))
+	defer pipeline.SetLogger(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	metrics := pipeline.NewMetrics()
+	options := pipeline.StageOptions{Workers: 2, Name: "slow", Hooks: metrics}
+	slow := pipeline.MapWithOptions(func(data int) int {
+		time.Sleep(5 * time.Millisecond)
+		return data
+	}, options)
+
+	err := pipeline.ExecutePipelineContext(
+		context.Background(),
+		func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; i < 10; i++ {
+				if err := pipeline.Send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		slow.ContextJob(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stage, ok := metrics.Snapshot()["slow"]
+	if !ok {
+		t.Fatalf("no metrics for the stage, got %v", metrics.Snapshot())
+	}
+	if stage.ItemsIn != 10 || stage.ItemsOut != 10 {
+		t.Errorf("items not counted\nGot: in=%d out=%d\nExpected: in=10 out=10", stage.ItemsIn, stage.ItemsOut)
+	}
+	if stage.Goroutines != 0 || stage.MaxGoroutines < 1 || stage.MaxGoroutines > 2 {
+		t.Errorf("goroutines not counted\nGot: current=%d max=%d", stage.Goroutines, stage.MaxGoroutines)
+	}
+	observed := 0
+	for _, count := range stage.Latency.Counts {
+		observed += count
+	}
+	if observed != 10 || stage.Latency.Sum < 50*time.Millisecond || stage.Latency.Counts[0] != 0 {
+		t.Errorf("latency histogram is wrong, got %+v", stage.Latency)
+	}
+
+	// Debug records are below the level of the handler
+	if !strings.Contains(logs.String(), `"msg":"pipeline completed"`) || strings.Contains(logs.String(), "DEBUG") {
+		t.Errorf("unexpected logs:\n%s", logs.String())
+	}
+}
+
+func TestStageMetricsDropped(t *testing.T) {
+	metrics := pipeline.NewMetrics()
+	deadLetters := make(chan pipeline.DeadLetter, 10)
+	failing := pipeline.TryMap(func(ctx context.Context, data int) (int, error) {
+		if data%2 == 1 {
+			return 0, errors.New("odd")
+		}
+		return data, nil
+	}, pipeline.StageOptions{Name: "failing", Hooks: metrics, DeadLetters: deadLetters})
+	if _, err := pipeline.Run(context.Background(), failing, []int{0, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	panicking := pipeline.MapWithOptions(func(data int) int {
+		panic("boom")
+	}, pipeline.StageOptions{Name: "panicking", Hooks: metrics, Workers: 2})
+	if _, err := pipeline.Run(context.Background(), panicking, []int{0, 1, 2}); err == nil {
+		t.Error("panic was not reported")
+	}
+
+	snapshot := metrics.Snapshot()
+	if stage := snapshot["failing"]; stage.ItemsIn != 5 || stage.ItemsOut != 3 {
+		t.Errorf("dead letters counted as sent\nGot: in=%d out=%d\nExpected: in=5 out=3", stage.ItemsIn, stage.ItemsOut)
+	}
+	if stage := snapshot["panicking"]; stage.ItemsOut != 0 || stage.Goroutines != 0 {
+		t.Errorf("panicked items still counted\nGot: out=%d goroutines=%d", stage.ItemsOut, stage.Goroutines)
+	}
+}
+
+func TestRetryAndDeadLetters(t *testing.T) {
+	var tries sync.Map
+	flaky := func(ctx context.Context, data int) (int, error) {
+		count, _ := tries.LoadOrStore(data, new(int32))
+		try := atomic.AddInt32(count.(*int32), 1)
+		switch {
+		case data == 1 && try < 3:
+			return 0, errors.New("temporary failure")
+		case data == 2:
+			panic("always broken")
+		case data == 3 && try == 1:
+			time.Sleep(100 * time.Millisecond)
+		}
+		return data * 10, nil
+	}
+	policy := pipeline.RetryPolicy{Attempts: 3, Timeout: 30 * time.Millisecond, InitialBackoff: time.Millisecond}
+
+	deadLetters := make(chan pipeline.DeadLetter, 10)
+	stage := pipeline.TryMap(flaky, pipeline.StageOptions{Name: "flaky", Retry: policy, DeadLetters: deadLetters, Ordered: true})
+	results, err := pipeline.Run(context.Background(), stage, []int{0, 1, 2, 3})
+	close(deadLetters)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(results) != "[0 10 30]" {
+		t.Errorf("results not match\nGot: %v\nExpected: [0 10 30]", results)
+	}
+	var letters []pipeline.DeadLetter
+	for letter := range deadLetters {
+		letters = append(letters, letter)
+	}
+	if len(letters) != 1 || letters[0].Item != 2 || letters[0].Attempts != 3 || letters[0].Stage != "flaky" ||
+		!strings.Contains(letters[0].Err.Error(), "always broken") {
+		t.Errorf("unexpected dead letters %+v", letters)
+	}
+
+	// without a dead-letter channel the failure stops the stage
+	stage = pipeline.TryMap(flaky, pipeline.StageOptions{Retry: policy})
+	_, err = pipeline.Run(context.Background(), stage, []int{2})
+	if err == nil || !strings.Contains(err.Error(), "failed after 3 attempts") {
+		t.Errorf("failure was not reported, got %v", err)
+	}
+
+	// a panicking signer ends up as a dead letter of the hash stage
+	deadLetters = make(chan pipeline.DeadLetter, 10)
+	brokenMd5 := func(data string) string {
+		if data == "7" {
+			panic("overheat")
+		}
+		return "md5(" + data + ")"
+	}
+	hashes, err := pipeline.Run(
+		context.Background(),
+		pipeline.SingleHashStage[int](brokenMd5, func(data string) string { return data }, pipeline.StageOptions{DeadLetters: deadLetters}),
+		[]int{6, 7},
+	)
+	close(deadLetters)
+	if err != nil || len(hashes) != 1 || len(deadLetters) != 1 {
+		t.Errorf("unexpected hash results %v, %d dead letters, error %v", hashes, len(deadLetters), err)
+	}
+	// the Job version has no error to return, the failed item is dropped
+	var jobHashes []interface{}
+	pipeline.ExecutePipeline(
+		Job(func(in, out chan interface{}) {
+			out <- 6
+			out <- 7
+		}),
+		Job(func(in, out chan interface{}) {
+			pipeline.SingleHashWithOptions(in, out, brokenMd5, func(data string) string { return data }, pipeline.StageOptions{})
+		}),
+		Job(func(in, out chan interface{}) {
+			for hash := range in {
+				jobHashes = append(jobHashes, hash)
+			}
+		}),
+	)
+	if len(jobHashes) != 1 || jobHashes[0] != hashes[0] {
+		t.Errorf("unexpected Job hash results %v", jobHashes)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	var mutex sync.Mutex
+	collected := map[string][]int{}
+	collect := func(name string) pipeline.ContextJob {
+		return func(ctx context.Context, in, out chan interface{}) error {
+			for data := range in {
+				mutex.Lock()
+				collected[name] = append(collected[name], data.(int))
+				mutex.Unlock()
+			}
+			return nil
+		}
+	}
+
+	var audited int32
+	err := pipeline.NewGraph().
+		Add("source", func(ctx context.Context, in, out chan interface{}) error {
+			for i := 1; i <= 6; i++ {
+				if err := pipeline.Send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, pipeline.StageOptions{}).
+		Add("square", pipeline.Map(func(data int) int { return data * data }).ContextJob(), pipeline.StageOptions{}).
+		Add("audit", func(ctx context.Context, in, out chan interface{}) error {
+			for data := range in {
+				atomic.AddInt32(&audited, 1)
+				if err := pipeline.Send(ctx, out, -data.(int)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, pipeline.StageOptions{}).
+		Add("even", collect("even"), pipeline.StageOptions{}).
+		Add("odd", collect("odd"), pipeline.StageOptions{}).
+		Connect("source", "square").
+		Connect("source", "audit").
+		Route("square", "even", func(data interface{}) bool { return data.(int)%2 == 0 }).
+		Route("square", "odd", func(data interface{}) bool { return data.(int)%2 != 0 }).
+		Route("audit", "even", func(data interface{}) bool { return data.(int) < -4 }).
+		Run(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(collected["even"])
+	slices.Sort(collected["odd"])
+	if fmt.Sprint(collected) != "map[even:[-6 -5 4 16 36] odd:[1 9 25]]" || audited != 6 {
+		t.Errorf("unexpected routing %v, audited %d", collected, audited)
+	}
+
+	err = pipeline.NewGraph().
+		Add("a", collect("a"), pipeline.StageOptions{}).
+		Add("b", collect("b"), pipeline.StageOptions{}).
+		Connect("a", "b").
+		Connect("b", "a").
+		Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle was not reported, got %v", err)
+	}
+
+	err = pipeline.NewGraph().
+		Add("source", func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; ; i++ {
+				if err := pipeline.Send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+		}, pipeline.StageOptions{BufferSize: 1}).
+		Add("broken", func(ctx context.Context, in, out chan interface{}) error {
+			<-in
+			return errors.New("broken branch")
+		}, pipeline.StageOptions{}).
+		Add("sink", collect("sink"), pipeline.StageOptions{}).
+		Connect("source", "broken").
+		Connect("source", "sink").
+		Run(context.Background())
+	if err == nil || err.Error() != "stage broken: broken branch" {
+		t.Errorf("branch failure was not reported, got %v", err)
+	}
+	err = pipeline.NewGraph().
+		Add("source", func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; i < 10; i++ {
+				if err := pipeline.Send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, pipeline.StageOptions{}).
+		Add("sink", collect("routed"), pipeline.StageOptions{}).
+		Route("source", "sink", func(data interface{}) bool { return data.(string) != "" }).
+		Run(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "stage source: predicate panic:") {
+		t.Errorf("predicate panic was not reported, got %v", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var running, maxRunning int32
+	limiter := pipeline.NewLimiter(pipeline.LimiterOptions{Concurrency: 2, CallsPerSecond: 100, Burst: 2})
+	call := pipeline.Limit(limiter, func(data int) int {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&maxRunning)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return data
+	})
+
+	start := time.Now()
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 12; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			call(i)
+		}()
+	}
+	waitGroup.Wait()
+
+	// 2 calls start right away, the other 10 one every 10ms
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("rate limit not applied, 12 calls took %s", elapsed)
+	}
+	if maxRunning > 2 {
+		t.Errorf("too many concurrent calls\nGot: %d\nExpected: <=2", maxRunning)
+	}
+	stats := limiter.Stats()
+	if stats.Calls != 12 || stats.TotalWait <= 0 || stats.MaxWait < 80*time.Millisecond {
+		t.Errorf("unexpected limiter stats %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	busy := pipeline.NewLimiter(pipeline.LimiterOptions{Concurrency: 1})
+	release, _ := busy.Acquire(context.Background())
+	if _, err := busy.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait was not reported, got %v", err)
+	}
+	release()
+
+	// SingleHash waits on the limiter it is given instead of its own one
+	md5Limiter := pipeline.NewLimiter(pipeline.LimiterOptions{Concurrency: 1})
+	_, err := pipeline.Run(
+		context.Background(),
+		pipeline.SingleHashStage[int](
+			func(data string) string { time.Sleep(time.Millisecond); return data },
+			func(data string) string { return data },
+			pipeline.StageOptions{Limiter: md5Limiter},
+		),
+		[]int{1, 2, 3, 4},
+	)
+	if err != nil || md5Limiter.Stats().Calls != 4 {
+		t.Errorf("md5 calls did not go through the limiter, error %v, stats %+v", err, md5Limiter.Stats())
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	var crc32Calls, md5Calls int32
+	slowCrc32 := func(data string) string {
+		atomic.AddInt32(&crc32Calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return data
+	}
+	countedMd5 := func(data string) string {
+		atomic.AddInt32(&md5Calls, 1)
+		return "md5(" + data + ")"
+	}
+
+	singleCache := pipeline.NewCache[string, string](10)
+	multiCache := pipeline.NewCache[string, string](10)
+	signer := pipeline.Then(
+		pipeline.SingleHashStage[int](countedMd5, slowCrc32, pipeline.StageOptions{Cache: singleCache}),
+		pipeline.MultiHashStage(slowCrc32, pipeline.StageOptions{Cache: multiCache}),
+	)
+	results, err := pipeline.Run(context.Background(), signer, []int{1, 1, 1, 2, 2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 distinct inputs, each needs 2 crc32 in SingleHash and 6 in MultiHash
+	if len(results) != 6 || md5Calls != 2 || crc32Calls != 16 {
+		t.Errorf("repeated inputs were recomputed\nGot: %d results, %d md5, %d crc32\nExpected: 6 results, 2 md5, 16 crc32",
+			len(results), md5Calls, crc32Calls)
+	}
+	if stats := singleCache.Stats(); stats.Misses != 2 || stats.Hits+stats.Shared != 4 || stats.Size != 2 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+
+	lru := pipeline.NewCache[int, int](2)
+	computed := 0
+	get := func(key int) {
+		lru.Get(key, func() (int, error) {
+			computed++
+			return key, nil
+		})
+	}
+	get(1)
+	get(2)
+	get(1)
+	get(3) // evicts 2, it was used least recently
+	get(1)
+	get(2)
+	if computed != 4 {
+		t.Errorf("least recently used value was not evicted\nGot: %d computations\nExpected: 4", computed)
+	}
+
+	failures := 0
+	for range 2 {
+		lru.Get(5, func() (int, error) {
+			failures++
+			return 0, errors.New("failed")
+		})
+	}
+	if failures != 2 {
+		t.Errorf("failed computation was cached")
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	var md5Calls int32
+	countedMd5 := func(data string) string {
+		atomic.AddInt32(&md5Calls, 1)
+		return "md5(" + data + ")"
+	}
+	crc32 := func(data string) string { return "crc(" + data + ")" }
+
+	run := func(inputData []int, checkpoint *pipeline.Checkpoint) string {
+		var result string
+		options := pipeline.StageOptions{Checkpoint: checkpoint}
+		pipeline.ExecutePipeline(
+			func(in, out chan interface{}) {
+				for _, data := range inputData {
+					out <- data
+				}
+			},
+			func(in, out chan interface{}) {
+				pipeline.SingleHashWithOptions(in, out, countedMd5, crc32, options)
+			},
+			func(in, out chan interface{}) {
+				pipeline.MultiHashWithOptions(in, out, crc32, options)
+			},
+			func(in, out chan interface{}) {
+				pipeline.CombineResultsWithOptions(in, out, options)
+			},
+			func(in, out chan interface{}) {
+				result = (<-in).(string)
+			},
+		)
+		return result
+	}
+
+	inputData := []int{0, 1, 1, 2, 3}
+	expected := run(inputData, nil)
+
+	path := t.TempDir() + "/progress.jsonl"
+
+	// the first run is interrupted after three items
+	checkpoint, err := pipeline.OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(inputData[:3], checkpoint)
+	checkpoint.Close()
+
+	// a crash in the middle of a write leaves an incomplete line behind
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"key":"2#0","res`)
+	file.Close()
+
+	checkpoint, err = pipeline.OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Len() != 3 {
+		t.Errorf("progress not restored\nGot: %d items\nExpected: 3", checkpoint.Len())
+	}
+
+	atomic.StoreInt32(&md5Calls, 0)
+	result := run(inputData, checkpoint)
+	if result != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", result, expected)
+	}
+	if md5Calls != 2 {
+		t.Errorf("finished items were recomputed\nGot: %d md5 calls\nExpected: 2", md5Calls)
+	}
+	if checkpoint.Len() != 5 {
+		t.Errorf("progress not saved\nGot: %d items\nExpected: 5", checkpoint.Len())
+	}
+	if err := checkpoint.Remove(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckpointLongRecords(t *testing.T) {
+	path := t.TempDir() + "/progress.jsonl"
+	// longer than the 64 KB line limit of bufio.Scanner
+	longKey := strings.Repeat("x", 100*1024) + "#0"
+	records := fmt.Sprintf(`{"key":%q,"result":"a"}`+"\n"+`{"key":"b#0","result":"b"}`+"\n", longKey)
+	if err := os.WriteFile(path, []byte(records), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := pipeline.OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.Close()
+	if checkpoint.Len() != 2 {
+		t.Errorf("progress not restored\nGot: %d items\nExpected: 2", checkpoint.Len())
+	}
+	if data, _ := os.ReadFile(path); string(data) != records {
+		t.Errorf("complete records were truncated, %d of %d bytes left", len(data), len(records))
+	}
+
+	// a complete line that is not a record is reported instead of dropped with all after it
+	if err := os.WriteFile(path, []byte("garbage\n"+records), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipeline.OpenCheckpoint(path); err == nil {
+		t.Error("expected an error for an invalid record")
+	}
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+var errComputationPanicked = errors.New("computation panicked")
+
+// CacheStats counts how Cache.Get calls were served.
+type CacheStats struct {
+	// Hits were answered from the cache.
+	Hits int
+	// Misses started a computation.
+	Misses int
+	// Shared waited for a computation another caller had already started.
+	Shared int
+	Size   int
+}
+
+// Cache is a bounded LRU of computed values. Concurrent calls for the same key
+// share one computation, failed computations are not remembered.
+type Cache[K comparable, V any] struct {
+	capacity int
+
+	mutex   sync.Mutex
+	entries map[K]*list.Element
+	recency *list.List
+	calls   map[K]*cacheCall[V]
+	stats   CacheStats
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+type cacheCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// NewCache creates a cache holding at most capacity values, at least one.
+func NewCache[K comparable, V any](capacity int) *Cache[K, V] {
+	return &Cache[K, V]{
+		capacity: max(capacity, 1),
+		entries:  map[K]*list.Element{},
+		recency:  list.New(),
+		calls:    map[K]*cacheCall[V]{},
+	}
+}
+
+// Get returns the value of key, calling compute only if it is neither cached
+// nor being computed right now.
+func (c *Cache[K, V]) Get(key K, compute func() (V, error)) (V, error) {
+	c.mutex.Lock()
+
+	if element, ok := c.entries[key]; ok {
+		c.recency.MoveToFront(element)
+		c.stats.Hits++
+		c.mutex.Unlock()
+		return element.Value.(*cacheEntry[K, V]).value, nil
+	}
+
+	if call, ok := c.calls[key]; ok {
+		c.stats.Shared++
+		c.mutex.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+
+	// the error is overwritten unless compute panics, waiters must not hang then
+	var call = &cacheCall[V]{done: make(chan struct{}), err: errComputationPanicked}
+	c.calls[key] = call
+	c.stats.Misses++
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		if call.err == nil {
+			c.add(key, call.value)
+		}
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.value, call.err = compute()
+	return call.value, call.err
+}
+
+// add must be called with the mutex held.
+func (c *Cache[K, V]) add(key K, value V) {
+	c.entries[key] = c.recency.PushFront(&cacheEntry[K, V]{key: key, value: value})
+
+	for c.recency.Len() > c.capacity {
+		var oldest = c.recency.Back()
+		c.recency.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[K, V]).key)
+	}
+}
+
+func (c *Cache[K, V]) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var stats = c.stats
+	stats.Size = c.recency.Len()
+	return stats
+}
+
+// memoized computes through cache when there is one.
+func memoized(cache *Cache[string, string], key string, compute func() (string, error)) (string, error) {
+	if cache == nil {
+		return compute()
+	}
+	return cache.Get(key, compute)
+}
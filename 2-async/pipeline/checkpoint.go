@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Checkpoint persists which inputs of a SingleHash -> MultiHash -> CombineResults run
+// have been combined, together with their results. It is an append-only file of
+// JSON lines, so a run that crashed leaves at most one incomplete line, which is ignored.
+//
+// An input is identified by its %v form and the number of equal inputs before it,
+// so the source must produce the same items in the same order when a run is resumed.
+type Checkpoint struct {
+	path string
+
+	mutex       sync.Mutex
+	file        *os.File
+	done        map[string]string
+	order       []string
+	occurrences map[string]int
+}
+
+type checkpointRecord struct {
+	Key    string `json:"key"`
+	Result string `json:"result"`
+}
+
+// OpenCheckpoint loads the progress saved in path, a missing file starts a new run.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	var checkpoint = &Checkpoint{
+		path:        path,
+		done:        map[string]string{},
+		occurrences: map[string]int{},
+	}
+
+	var file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint '%s', error %s", path, err)
+	}
+
+	// keys are the %v of any input, so lines are not limited in length like bufio.Scanner does
+	var reader = bufio.NewReader(file)
+	var valid int64
+	for {
+		var line []byte
+		line, err = reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a line without its newline is the one a crash left incomplete,
+			// new records must not be glued to it
+			if len(line) != 0 {
+				err = file.Truncate(valid)
+			} else {
+				err = nil
+			}
+			break
+		}
+		if err != nil {
+			break
+		}
+
+		var record checkpointRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			err = fmt.Errorf("invalid record at offset %d: %w", valid, err)
+			break
+		}
+		valid += int64(len(line))
+
+		if _, ok := checkpoint.done[record.Key]; !ok {
+			checkpoint.order = append(checkpoint.order, record.Key)
+		}
+		checkpoint.done[record.Key] = record.Result
+	}
+
+	if err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read checkpoint '%s', error %s", path, err)
+	}
+
+	checkpoint.file = file
+	return checkpoint, nil
+}
+
+// Len returns the number of inputs already combined.
+func (c *Checkpoint) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.done)
+}
+
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
+
+// Remove deletes the checkpoint, e.g. once the run has completed.
+func (c *Checkpoint) Remove() error {
+	c.file.Close()
+	return os.Remove(c.path)
+}
+
+// pending gives every item of inputChannel its key and leaves out the ones already combined.
+func (c *Checkpoint) pending(inputChannel chan interface{}) chan interface{} {
+	var outputChannel = make(chan interface{}, DefaultBufferSize)
+
+	go func() {
+		defer close(outputChannel)
+
+		for data := range inputChannel {
+			var value = fmt.Sprintf("%v", data)
+
+			c.mutex.Lock()
+			var key = fmt.Sprintf("%s#%d", value, c.occurrences[value])
+			c.occurrences[value]++
+			var _, done = c.done[key]
+			c.mutex.Unlock()
+
+			if done {
+				logger().Debug("checkpoint skips item", "key", key)
+				continue
+			}
+			outputChannel <- trackedItem{key: key, value: value}
+		}
+	}()
+
+	return outputChannel
+}
+
+// results returns the results saved so far, in the order they were combined.
+func (c *Checkpoint) results() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var results = make([]string, 0, len(c.order))
+	for _, key := range c.order {
+		results = append(results, c.done[key])
+	}
+	return results
+}
+
+func (c *Checkpoint) record(key string, result string) error {
+	var line, err = json.Marshal(checkpointRecord{Key: key, Result: result})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err = c.file.Write(append(line, '\n'))
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint '%s', error %s", c.path, err)
+	}
+
+	if _, ok := c.done[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.done[key] = result
+	return nil
+}
+
+// trackedItem carries the checkpoint key of an input through the stages,
+// stages that format items with %v only see the value.
+type trackedItem struct {
+	key   string
+	value string
+}
+
+func (t trackedItem) String() string {
+	return t.value
+}
+
+// retag keeps the checkpoint key of data on the result computed from it.
+func retag(data interface{}, result string) interface{} {
+	if tracked, ok := data.(trackedItem); ok {
+		return trackedItem{key: tracked.key, value: result}
+	}
+	return result
+}
@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
@@ -10,20 +11,63 @@ func CombineResults(
 	inputChannel chan interface{},
 	outputChannel chan interface{},
 ) {
-	fmt.Println("CombineResults start")
+	CombineResultsWithOptions(inputChannel, outputChannel, StageOptions{})
+}
+
+// CombineResultsWithOptions keeps the arrival order when options.Ordered is set,
+// the stages before it are then expected to be ordered too, so no sort is needed.
+// Results restored from options.Checkpoint come before the ones of the current run.
+func CombineResultsWithOptions(
+	inputChannel chan interface{},
+	outputChannel chan interface{},
+	options StageOptions,
+) {
+	logger().Info("stage started", "stage", "CombineResults")
 
 	var results = make([]string, 0)
+	if options.Checkpoint != nil {
+		results = options.Checkpoint.results()
+		logger().Info("CombineResults restored results", "count", len(results))
+	}
 
 	for rawData := range inputChannel {
 		var data = fmt.Sprintf("%v", rawData)
-		fmt.Println("CombineResults received data", data)
+		logger().Debug("CombineResults received data", "data", data)
 		results = append(results, data)
+
+		if tracked, ok := rawData.(trackedItem); ok && options.Checkpoint != nil {
+			// losing the checkpoint only costs a recomputation, the run itself goes on
+			var err = options.Checkpoint.record(tracked.key, data)
+			if err != nil {
+				logger().Error("CombineResults failed to save progress", "error", err)
+			}
+		}
 	}
 
-	sort.Strings(results)
+	outputChannel <- combineResults(results, options.Ordered)
+}
+
+// CombineResultsStage is the typed version of CombineResultsWithOptions.
+func CombineResultsStage(options StageOptions) Stage[string, string] {
+	return func(ctx context.Context, in <-chan string, out chan<- string) error {
+		var results = make([]string, 0)
+
+		for data := range in {
+			logger().Debug("CombineResults received data", "data", data)
+			results = append(results, data)
+		}
+
+		return SendTyped(ctx, out, combineResults(results, options.Ordered))
+	}
+}
+
+func combineResults(results []string, ordered bool) string {
+	if !ordered {
+		sort.Strings(results)
+	}
 
 	var result = strings.Join(results, "_")
-	fmt.Println("Combine results", result)
+	logger().Debug("CombineResults result", "result", result)
 
-	outputChannel <- result
+	return result
 }
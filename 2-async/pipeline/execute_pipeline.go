@@ -1,13 +1,18 @@
 package pipeline
 
 import (
-	"fmt"
 	"sync"
 )
 
 type Job func(in, out chan interface{})
 
 func ExecutePipeline(jobs ...Job) {
+	ExecutePipelineWithOptions(StageOptions{}, jobs...)
+}
+
+// ExecutePipelineWithOptions is ExecutePipeline with options.BufferSize items
+// in every channel between two jobs.
+func ExecutePipelineWithOptions(options StageOptions, jobs ...Job) {
 	var inputChannel chan interface{}
 	var outputChannel chan interface{}
 
@@ -16,10 +21,10 @@ func ExecutePipeline(jobs ...Job) {
 	for i, job := range jobs {
 		waitGroup.Add(1)
 
-		fmt.Println("Job", i)
+		logger().Info("job started", "pipeline", "ExecutePipeline", "job", i)
 
 		inputChannel = outputChannel
-		outputChannel = make(chan interface{}, 100)
+		outputChannel = make(chan interface{}, options.bufferSize())
 
 		var goroutine = func(
 			job Job,
@@ -35,7 +40,6 @@ func ExecutePipeline(jobs ...Job) {
 		go goroutine(job, inputChannel, outputChannel)
 	}
 
-	fmt.Println("ExecutePipeline waiting for the end")
 	waitGroup.Wait()
-	fmt.Println("ExecutePipeline completed")
+	logger().Info("pipeline completed", "pipeline", "ExecutePipeline")
 }
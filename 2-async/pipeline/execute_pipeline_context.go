@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ContextJob is a Job that can be cancelled and can fail.
+// It should stop as soon as ctx is done, Send helps with that when writing to out.
+type ContextJob func(ctx context.Context, in, out chan interface{}) error
+
+// WithContext adapts a plain Job. The job itself cannot be interrupted,
+// but ExecutePipelineContext keeps draining its channels, so it is never stuck on them.
+func WithContext(job Job) ContextJob {
+	return func(ctx context.Context, in, out chan interface{}) error {
+		job(in, out)
+		return nil
+	}
+}
+
+// Send writes value to out unless ctx is cancelled first.
+func Send(ctx context.Context, out chan interface{}, value interface{}) error {
+	select {
+	case out <- value:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// ConfiguredJob is a job together with the options of the channel it writes to.
+type ConfiguredJob struct {
+	Job     ContextJob
+	Options StageOptions
+}
+
+// ExecutePipelineContext runs jobs like ExecutePipeline. The first job error or panic,
+// including a panic of a transform inside a typed stage, cancels the context of every stage,
+// and it is returned once all stages have stopped.
+// Cancellation of ctx itself is reported as its cause.
+func ExecutePipelineContext(ctx context.Context, jobs ...ContextJob) error {
+	var configuredJobs = make([]ConfiguredJob, 0, len(jobs))
+	for _, job := range jobs {
+		configuredJobs = append(configuredJobs, ConfiguredJob{Job: job})
+	}
+	return ExecuteConfiguredPipeline(ctx, configuredJobs...)
+}
+
+// ExecuteConfiguredPipeline is ExecutePipelineContext with a buffer size per job.
+func ExecuteConfiguredPipeline(ctx context.Context, jobs ...ConfiguredJob) error {
+	if len(jobs) == 0 {
+		return context.Cause(ctx)
+	}
+
+	var pipelineContext, cancel = context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var inputChannel chan interface{}
+	var outputChannel chan interface{}
+
+	var waitGroup = &sync.WaitGroup{}
+
+	for i, configuredJob := range jobs {
+		waitGroup.Add(1)
+
+		logger().Info("job started", "pipeline", "ExecutePipelineContext", "job", i)
+
+		inputChannel = outputChannel
+		outputChannel = make(chan interface{}, configuredJob.Options.bufferSize())
+
+		var goroutine = func(
+			i int,
+			job ContextJob,
+			inputChannel chan interface{},
+			outputChannel chan interface{},
+		) {
+			defer waitGroup.Done()
+			defer close(outputChannel)
+
+			// a stage that stopped early must not block the one before it,
+			// so whatever is still coming is read and thrown away
+			defer func() {
+				if inputChannel != nil {
+					for range inputChannel {
+					}
+				}
+			}()
+
+			var err = runJob(pipelineContext, job, inputChannel, outputChannel)
+			if err != nil {
+				cancel(fmt.Errorf("job %d: %w", i, err))
+			}
+		}
+
+		go goroutine(i, configuredJob.Job, inputChannel, outputChannel)
+	}
+
+	// nobody reads the output of the last job
+	go func() {
+		for range outputChannel {
+		}
+	}()
+
+	waitGroup.Wait()
+
+	var err = context.Cause(pipelineContext)
+	if err != nil {
+		logger().Error("pipeline failed", "pipeline", "ExecutePipelineContext", "error", err)
+	} else {
+		logger().Info("pipeline completed", "pipeline", "ExecutePipelineContext")
+	}
+	return err
+}
+
+func runJob(
+	ctx context.Context,
+	job ContextJob,
+	inputChannel chan interface{},
+	outputChannel chan interface{},
+) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	return job(ctx, inputChannel, outputChannel)
+}
@@ -0,0 +1,267 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Graph runs jobs connected as a directed acyclic graph instead of a chain.
+// An item written by a job goes to every outgoing edge whose predicate accepts it,
+// so several edges broadcast and predicates route. A job with several incoming
+// edges reads all of them merged, in arrival order.
+type Graph struct {
+	nodes []*graphNode
+	edges []*graphEdge
+	err   error
+}
+
+type graphNode struct {
+	name     string
+	job      ContextJob
+	options  StageOptions
+	inputs   []*graphEdge
+	outputs  []*graphEdge
+	incoming int
+}
+
+type graphEdge struct {
+	from      string
+	to        string
+	predicate func(data interface{}) bool
+	channel   chan interface{}
+}
+
+func NewGraph() *Graph {
+	return &Graph{}
+}
+
+// Add registers a job under a unique name, options.BufferSize applies to its output.
+// Jobs without incoming edges read a closed channel, the output of jobs without
+// outgoing edges is thrown away.
+func (g *Graph) Add(name string, job ContextJob, options StageOptions) *Graph {
+	if g.node(name) != nil {
+		g.err = errors.Join(g.err, fmt.Errorf("stage %s is added twice", name))
+		return g
+	}
+
+	g.nodes = append(g.nodes, &graphNode{name: name, job: job, options: options})
+	return g
+}
+
+// Connect sends every item of from to to.
+func (g *Graph) Connect(from string, to string) *Graph {
+	return g.Route(from, to, nil)
+}
+
+// Route sends the items of from accepted by predicate to to, nil accepts everything.
+// Predicates of different edges are independent, an item may go to several of them or to none.
+func (g *Graph) Route(from string, to string, predicate func(data interface{}) bool) *Graph {
+	g.edges = append(g.edges, &graphEdge{from: from, to: to, predicate: predicate})
+	return g
+}
+
+func (g *Graph) node(name string) *graphNode {
+	for _, node := range g.nodes {
+		if node.name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// link resolves the edges and checks that the graph has no cycles.
+func (g *Graph) link() error {
+	if g.err != nil {
+		return g.err
+	}
+
+	for _, node := range g.nodes {
+		node.inputs, node.outputs, node.incoming = nil, nil, 0
+	}
+
+	for _, edge := range g.edges {
+		var from, to = g.node(edge.from), g.node(edge.to)
+		if from == nil || to == nil {
+			return fmt.Errorf("edge %s -> %s refers to an unknown stage", edge.from, edge.to)
+		}
+		from.outputs = append(from.outputs, edge)
+		to.inputs = append(to.inputs, edge)
+		to.incoming++
+	}
+
+	// Kahn's algorithm, whatever is left unvisited lies on a cycle
+	var ready = make([]*graphNode, 0, len(g.nodes))
+	for _, node := range g.nodes {
+		if node.incoming == 0 {
+			ready = append(ready, node)
+		}
+	}
+
+	var visited = 0
+	for len(ready) != 0 {
+		var node = ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		visited++
+
+		for _, edge := range node.outputs {
+			var next = g.node(edge.to)
+			next.incoming--
+			if next.incoming == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	if visited != len(g.nodes) {
+		return errors.New("stages form a cycle")
+	}
+	return nil
+}
+
+// Run starts every job and waits for all of them. Like ExecutePipelineContext, the first
+// error or panic cancels all jobs and is returned, prefixed with the name of the job.
+func (g *Graph) Run(ctx context.Context) error {
+	var err = g.link()
+	if err != nil {
+		return err
+	}
+
+	var graphContext, cancel = context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var waitGroup = &sync.WaitGroup{}
+
+	for _, node := range g.nodes {
+		for _, edge := range node.outputs {
+			edge.channel = make(chan interface{}, node.options.bufferSize())
+		}
+	}
+
+	for _, node := range g.nodes {
+		var inputChannel = g.mergeInputs(graphContext, node, waitGroup)
+		var outputChannel = make(chan interface{}, node.options.bufferSize())
+
+		waitGroup.Add(2)
+
+		go func() {
+			defer waitGroup.Done()
+			defer close(outputChannel)
+			defer drain(inputChannel)
+
+			logger().Info("job started", "pipeline", "Graph", "job", node.name)
+
+			var err = runJob(graphContext, node.job, inputChannel, outputChannel)
+			if err != nil {
+				cancel(fmt.Errorf("stage %s: %w", node.name, err))
+			}
+		}()
+
+		go func() {
+			defer waitGroup.Done()
+
+			var err = g.dispatch(graphContext, node, outputChannel)
+			if err != nil {
+				cancel(fmt.Errorf("stage %s: %w", node.name, err))
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+
+	err = context.Cause(graphContext)
+	if err != nil {
+		logger().Error("pipeline failed", "pipeline", "Graph", "error", err)
+	} else {
+		logger().Info("pipeline completed", "pipeline", "Graph")
+	}
+	return err
+}
+
+// mergeInputs returns the channel node reads from, one goroutine per edge
+// copies into it when there are several.
+func (g *Graph) mergeInputs(ctx context.Context, node *graphNode, waitGroup *sync.WaitGroup) chan interface{} {
+	switch len(node.inputs) {
+	case 0:
+		var empty = make(chan interface{})
+		close(empty)
+		return empty
+	case 1:
+		return node.inputs[0].channel
+	}
+
+	var merged = make(chan interface{}, DefaultBufferSize)
+	var mergeGroup = &sync.WaitGroup{}
+
+	for _, edge := range node.inputs {
+		mergeGroup.Add(1)
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+			defer mergeGroup.Done()
+			defer drain(edge.channel)
+
+			for data := range edge.channel {
+				if Send(ctx, merged, data) != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		mergeGroup.Wait()
+		close(merged)
+	}()
+
+	return merged
+}
+
+// dispatch copies the output of node to its edges and closes them once the output is closed.
+// A panic of a predicate is returned, the rest of the output is then dropped.
+func (g *Graph) dispatch(ctx context.Context, node *graphNode, outputChannel chan interface{}) error {
+	defer func() {
+		for _, edge := range node.outputs {
+			close(edge.channel)
+		}
+	}()
+
+	for data := range outputChannel {
+		for _, edge := range node.outputs {
+			var accepted, err = edge.accepts(data)
+			if err != nil {
+				drain(outputChannel)
+				return err
+			}
+			if !accepted {
+				continue
+			}
+			if Send(ctx, edge.channel, data) != nil {
+				// the graph is cancelled, the job must still be able to finish its writes
+				drain(outputChannel)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// accepts runs the predicate of the edge, turning its panic into an error.
+func (e *graphEdge) accepts(data interface{}) (accepted bool, err error) {
+	if e.predicate == nil {
+		return true, nil
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("predicate panic: %v", recovered)
+		}
+	}()
+
+	return e.predicate(data), nil
+}
@@ -0,0 +1,140 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LimiterOptions configures a Limiter, zero values mean no limit.
+type LimiterOptions struct {
+	// Concurrency is the maximum number of calls running at the same time.
+	Concurrency int
+	// CallsPerSecond is the rate at which calls may start.
+	CallsPerSecond float64
+	// Burst is the number of calls that may start at once after an idle period, at least 1.
+	Burst int
+}
+
+// LimiterStats describes how long callers waited for a Limiter.
+type LimiterStats struct {
+	Calls     int64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// Limiter protects an external function from too many concurrent calls
+// and from calls that come too often, combining a semaphore with a token bucket.
+type Limiter struct {
+	slots chan struct{}
+	rate  float64
+	burst float64
+
+	mutex      sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+	stats      LimiterStats
+}
+
+func NewLimiter(options LimiterOptions) *Limiter {
+	var limiter = &Limiter{
+		rate:       options.CallsPerSecond,
+		burst:      float64(max(options.Burst, 1)),
+		lastRefill: time.Now(),
+	}
+	limiter.tokens = limiter.burst
+
+	if options.Concurrency > 0 {
+		limiter.slots = make(chan struct{}, options.Concurrency)
+	}
+	return limiter
+}
+
+// Acquire waits until a call may start. The returned release must be called when
+// the call is over, unless an error is returned because ctx was cancelled first.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	var start = time.Now()
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	var err = l.waitToken(ctx)
+	if err != nil {
+		l.releaseSlot()
+		return nil, err
+	}
+
+	l.record(time.Since(start))
+	return l.releaseSlot, nil
+}
+
+func (l *Limiter) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// waitToken takes a token, possibly ahead of time, and sleeps until it would have been there.
+func (l *Limiter) waitToken(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	var now = time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.lastRefill).Seconds()*l.rate)
+	l.lastRefill = now
+	l.tokens--
+	var delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	var timer = time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// the token was never used, later callers need not wait for it
+		l.mutex.Lock()
+		l.tokens++
+		l.mutex.Unlock()
+		return context.Cause(ctx)
+	}
+}
+
+func (l *Limiter) record(wait time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.stats.Calls++
+	l.stats.TotalWait += wait
+	l.stats.MaxWait = max(l.stats.MaxWait, wait)
+}
+
+// Stats returns the waiting time of all calls so far.
+func (l *Limiter) Stats() LimiterStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.stats
+}
+
+// Limit wraps call so that every invocation goes through limiter.
+func Limit[In, Out any](limiter *Limiter, call func(In) Out) func(In) Out {
+	return func(data In) Out {
+		var release, _ = limiter.Acquire(context.Background())
+		defer release()
+
+		return call(data)
+	}
+}
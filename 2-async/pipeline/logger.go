@@ -0,0 +1,28 @@
+package pipeline
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+var currentLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	// every step is logged by default, as the stages always printed their progress
+	currentLogger.Store(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+}
+
+// SetLogger replaces the logger used by all stages, nil turns logging off.
+// Start and end of stages are logged at Info level, every computed hash at Debug level.
+func SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	currentLogger.Store(logger)
+}
+
+func logger() *slog.Logger {
+	return currentLogger.Load()
+}
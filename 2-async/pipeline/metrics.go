@@ -0,0 +1,196 @@
+package pipeline
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StageHooks receives the events of stages created with StageOptions.Hooks.
+// Methods are called concurrently from the goroutines transforming items.
+type StageHooks interface {
+	// ItemStarted is called when a transform starts, queueDepth is the number of items
+	// still waiting in the input channel of the stage.
+	ItemStarted(stage string, queueDepth int)
+	// ItemFinished is called when a transform returns.
+	ItemFinished(stage string, latency time.Duration)
+	// ItemSent is called when a result has been written to the output of the stage,
+	// results that are dropped, e.g. dead letters or on cancellation, are not sent.
+	ItemSent(stage string)
+	// GoroutinesChanged reports how many goroutines are transforming items right now.
+	GoroutinesChanged(stage string, goroutines int)
+}
+
+// instrument wraps transform so that it reports to options.Hooks.
+func instrument[In, Out any](
+	inputChannel <-chan In,
+	transform func(In) Out,
+	options StageOptions,
+) func(In) Out {
+	if options.Hooks == nil {
+		return transform
+	}
+
+	var hooks, name = options.Hooks, options.Name
+	var goroutines atomic.Int64
+
+	return func(data In) Out {
+		hooks.GoroutinesChanged(name, int(goroutines.Add(1)))
+		// deferred, a transform that panics is not running anymore either
+		defer func() {
+			hooks.GoroutinesChanged(name, int(goroutines.Add(-1)))
+		}()
+		hooks.ItemStarted(name, len(inputChannel))
+
+		var start = time.Now()
+		var result = transform(data)
+
+		hooks.ItemFinished(name, time.Since(start))
+
+		return result
+	}
+}
+
+// sendItem writes value to out and reports it to options.Hooks once it is there.
+func sendItem[T any](ctx context.Context, out chan<- T, value T, options StageOptions) {
+	var err = SendTyped(ctx, out, value)
+	if err == nil && options.Hooks != nil {
+		options.Hooks.ItemSent(options.Name)
+	}
+}
+
+// unsentHooks is for an inner stage whose results are sent on by the outer one,
+// which reports ItemSent itself.
+type unsentHooks struct {
+	StageHooks
+}
+
+func (unsentHooks) ItemSent(string) {}
+
+// DefaultLatencyBounds are the upper bounds of the latency histogram buckets of Metrics.
+var DefaultLatencyBounds = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts latencies per bucket, Counts[i] holds the latencies
+// up to Bounds[i] and the last count holds everything above the last bound.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []int
+	Sum    time.Duration
+}
+
+func (h *LatencyHistogram) observe(latency time.Duration) {
+	var bucket, _ = slices.BinarySearch(h.Bounds, latency)
+	h.Counts[bucket]++
+	h.Sum += latency
+}
+
+// StageMetrics is what Metrics knows about one stage.
+type StageMetrics struct {
+	ItemsIn       int
+	ItemsOut      int
+	QueueDepth    int
+	MaxQueueDepth int
+	Goroutines    int
+	MaxGoroutines int
+	Latency       LatencyHistogram
+}
+
+// Metrics is a StageHooks collecting StageMetrics per stage name.
+type Metrics struct {
+	mutex  sync.Mutex
+	stages map[string]*StageMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stages: map[string]*StageMetrics{}}
+}
+
+// stage must be called with the mutex held.
+func (m *Metrics) stage(name string) *StageMetrics {
+	var stageMetrics, ok = m.stages[name]
+	if !ok {
+		stageMetrics = &StageMetrics{
+			Latency: LatencyHistogram{
+				Bounds: DefaultLatencyBounds,
+				Counts: make([]int, len(DefaultLatencyBounds)+1),
+			},
+		}
+		m.stages[name] = stageMetrics
+	}
+	return stageMetrics
+}
+
+func (m *Metrics) ItemStarted(stage string, queueDepth int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var stageMetrics = m.stage(stage)
+	stageMetrics.ItemsIn++
+	stageMetrics.QueueDepth = queueDepth
+	stageMetrics.MaxQueueDepth = max(stageMetrics.MaxQueueDepth, queueDepth)
+}
+
+func (m *Metrics) ItemFinished(stage string, latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var stageMetrics = m.stage(stage)
+	stageMetrics.Latency.observe(latency)
+}
+
+func (m *Metrics) ItemSent(stage string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stage(stage).ItemsOut++
+}
+
+func (m *Metrics) GoroutinesChanged(stage string, goroutines int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var stageMetrics = m.stage(stage)
+	stageMetrics.Goroutines = goroutines
+	stageMetrics.MaxGoroutines = max(stageMetrics.MaxGoroutines, goroutines)
+}
+
+// Snapshot returns a copy of the metrics of every stage seen so far.
+func (m *Metrics) Snapshot() map[string]StageMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var snapshot = make(map[string]StageMetrics, len(m.stages))
+	for name, stageMetrics := range m.stages {
+		var copied = *stageMetrics
+		copied.Latency.Counts = slices.Clone(stageMetrics.Latency.Counts)
+		snapshot[name] = copied
+	}
+	return snapshot
+}
+
+// LogHooks is a StageHooks tracing every event to the package logger at Debug level.
+type LogHooks struct{}
+
+func (LogHooks) ItemStarted(stage string, queueDepth int) {
+	logger().Debug("item started", "stage", stage, "queue_depth", queueDepth)
+}
+
+func (LogHooks) ItemFinished(stage string, latency time.Duration) {
+	logger().Debug("item finished", "stage", stage, "latency", latency)
+}
+
+func (LogHooks) ItemSent(stage string) {
+	logger().Debug("item sent", "stage", stage)
+}
+
+func (LogHooks) GoroutinesChanged(stage string, goroutines int) {
+	logger().Debug("goroutines changed", "stage", stage, "goroutines", goroutines)
+}
@@ -1,55 +1,89 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
 )
 
+const multiHashThreads = 6
+
 func MultiHash(
 	inputChannel chan interface{},
 	outputChannel chan interface{},
 	dataSignerCrc32 func(data string) string,
 ) {
-	fmt.Println("MultiHash start")
-	const threads = 6
+	MultiHashWithOptions(inputChannel, outputChannel, dataSignerCrc32, StageOptions{})
+}
+
+// MultiHashWithOptions is MultiHash with retries, dead letters and options.Workers items in flight.
+func MultiHashWithOptions(
+	inputChannel chan interface{},
+	outputChannel chan interface{},
+	dataSignerCrc32 func(data string) string,
+	options StageOptions,
+) {
+	logger().Info("stage started", "stage", "MultiHash")
 
-	PipelineStage(
+	var err = tryTransformItems(
+		context.Background(),
 		inputChannel,
 		outputChannel,
-		func(data string) string {
-			var results = make([]string, threads)
+		func(ctx context.Context, data interface{}) (interface{}, error) {
+			var key = fmt.Sprintf("%v", data)
+			var result, err = memoized(options.Cache, key, func() (string, error) {
+				return multiHash(key, dataSignerCrc32)
+			})
+			return retag(data, result), err
+		},
+		options.named("MultiHash").forJob(),
+	)
+	if err != nil {
+		logger().Error("stage failed", "stage", "MultiHash", "error", err)
+	}
+}
 
-			var waitGroup = &sync.WaitGroup{}
-			var mutex = &sync.Mutex{}
+// MultiHashStage is the typed version of MultiHashWithOptions.
+func MultiHashStage(dataSignerCrc32 func(data string) string, options StageOptions) Stage[string, string] {
+	return TryMap(func(ctx context.Context, data string) (string, error) {
+		return memoized(options.Cache, data, func() (string, error) {
+			return multiHash(data, dataSignerCrc32)
+		})
+	}, options.named("MultiHash"))
+}
 
-			for i := range threads {
-				waitGroup.Add(1)
+// multiHash concatenates crc32(th+data) for th=0..5 in the order of th.
+func multiHash(data string, dataSignerCrc32 func(data string) string) (string, error) {
+	var results = make([]string, multiHashThreads)
+	var errs = make([]error, multiHashThreads)
 
-				go func() {
-					defer waitGroup.Done()
+	var waitGroup = &sync.WaitGroup{}
 
-					var crcHash = dataSignerCrc32(
-						fmt.Sprintf("%v%v", i, data),
-					)
-					fmt.Println("MultiHash crc32(threads+data)", i, crcHash)
+	for i := range multiHashThreads {
+		waitGroup.Add(1)
 
-					mutex.Lock()
-					results[i] = crcHash
-					mutex.Unlock()
-				}()
-			}
+		go func() {
+			defer waitGroup.Done()
 
-			waitGroup.Wait()
+			results[i], errs[i] = callSigner(
+				dataSignerCrc32,
+				fmt.Sprintf("%v%v", i, data),
+			)
+			logger().Debug("MultiHash crc32(th+data)", "data", data, "th", i, "hash", results[i])
+		}()
+	}
 
-			mutex.Lock()
-			var result = strings.Join(results, "")
-			mutex.Unlock()
+	waitGroup.Wait()
 
-			fmt.Println("MultiHash result", result)
-			fmt.Println()
+	var err = errors.Join(errs...)
+	if err != nil {
+		return "", err
+	}
 
-			return result
-		},
-	)
+	var result = strings.Join(results, "")
+	logger().Debug("MultiHash result", "data", data, "result", result)
+
+	return result, nil
 }
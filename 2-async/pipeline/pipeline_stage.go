@@ -1,29 +1,251 @@
 package pipeline
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
 
+// DefaultBufferSize is the capacity of channels between stages unless configured otherwise.
+const DefaultBufferSize = 100
+
+// StageOptions bounds the resources a stage may use. Zero values keep the defaults:
+// one goroutine per item and DefaultBufferSize for the output channel.
+type StageOptions struct {
+	// Workers is the maximum number of items transformed at the same time.
+	Workers int
+	// BufferSize is the capacity of the channel the stage writes to, a full channel
+	// blocks the stage and so applies backpressure upstream. It sizes the channels
+	// created by ExecutePipelineWithOptions, ExecuteConfiguredPipeline, Graph and ThenWithOptions.
+	BufferSize int
+	// Ordered makes a parallel stage emit results in input order.
+	// A slow item then holds back the ones after it, with Workers set
+	// at most Workers items are in flight or waiting to be emitted.
+	Ordered bool
+	// Name identifies the stage in hooks, the hash stages name themselves if it is empty.
+	Name string
+	// Hooks receives per-item events of the stage, nil disables them.
+	Hooks StageHooks
+	// Retry applies to stages whose transform can fail, like TryMap and the hash stages.
+	Retry RetryPolicy
+	// DeadLetters receives items that failed every attempt, without it the first such item
+	// fails the stage. The Job versions of the hash stages cannot report that error,
+	// they log and drop such an item instead.
+	DeadLetters chan<- DeadLetter
+	// Limiter guards the external function of a stage that cannot be called freely,
+	// dataSignerMd5 for the SingleHash stages. Nil keeps the stage default.
+	Limiter *Limiter
+	// Cache remembers the results of the hash stages by input, repeated inputs
+	// are then hashed once. A cache must not be shared by different kinds of stages.
+	Cache *Cache[string, string]
+	// Checkpoint makes SingleHash skip inputs that a previous run has already combined
+	// and CombineResults restore their results. Only the Job versions support it.
+	Checkpoint *Checkpoint
+
+	// dropFailed skips items failing every attempt instead of failing the stage
+	// when there is no DeadLetters.
+	dropFailed bool
+}
+
+func (o StageOptions) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return DefaultBufferSize
+	}
+	return o.BufferSize
+}
+
+// forJob is for the Job versions of stages, which have nobody to return an error to.
+func (o StageOptions) forJob() StageOptions {
+	o.dropFailed = true
+	return o
+}
+
+func (o StageOptions) named(name string) StageOptions {
+	if o.Name == "" {
+		o.Name = name
+	}
+	return o
+}
+
 func PipelineStage(
 	inputChannel chan interface{},
 	outputChannel chan interface{},
 	transform func(string string) string,
 ) {
+	PipelineStageWithOptions(inputChannel, outputChannel, transform, StageOptions{})
+}
+
+// PipelineStageWithOptions is PipelineStage with at most options.Workers transforms in flight.
+func PipelineStageWithOptions(
+	inputChannel chan interface{},
+	outputChannel chan interface{},
+	transform func(string string) string,
+	options StageOptions,
+) {
+	var err = transformItems(
+		context.Background(),
+		inputChannel,
+		outputChannel,
+		func(data interface{}) interface{} {
+			return transform(fmt.Sprintf("%v", data))
+		},
+		options,
+	)
+	// a panic of transform is raised again here, where ExecutePipelineContext can recover it
+	if err != nil {
+		panic(err)
+	}
+}
+
+// transformItems reads inputChannel until it is closed and sends the transformed items
+// in completion order. Without Workers every item gets its own goroutine,
+// otherwise a fixed pool reads the input, so unread items stay in the upstream channel.
+// A panic of transform stops the stage and is returned as its error,
+// the remaining input is then only drained.
+func transformItems[In, Out any](
+	ctx context.Context,
+	inputChannel <-chan In,
+	outputChannel chan<- Out,
+	transform func(In) Out,
+	options StageOptions,
+) error {
+	var stageContext, cancel = context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	transform = instrument(inputChannel, transform, options)
+
+	if options.Ordered {
+		transformItemsOrdered(stageContext, cancel, inputChannel, outputChannel, transform, options)
+		return context.Cause(stageContext)
+	}
+
+	var transformItem = func(data In) {
+		defer recoverTransform(cancel)
+
+		if stageContext.Err() == nil {
+			sendItem(stageContext, outputChannel, transform(data), options)
+		}
+	}
+
+	var workers = options.Workers
 	waitGroup := &sync.WaitGroup{}
 
-	for data := range inputChannel {
-		waitGroup.Add(1)
+	if workers <= 0 {
+		for data := range inputChannel {
+			waitGroup.Add(1)
 
-		var data = fmt.Sprintf("%v", data)
+			var goroutine = func(data In) {
+				defer waitGroup.Done()
+				transformItem(data)
+			}
 
-		var goroutine = func(data string) {
-			defer waitGroup.Done()
-			outputChannel <- transform(data)
+			go goroutine(data)
 		}
 
-		go goroutine(data)
+		waitGroup.Wait()
+		return context.Cause(stageContext)
+	}
+
+	for range workers {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			for data := range inputChannel {
+				transformItem(data)
+			}
+		}()
 	}
 
 	waitGroup.Wait()
+	return context.Cause(stageContext)
+}
+
+// recoverTransform turns a panic of a transform into the cause cancelling its stage,
+// the goroutines running transforms have nobody to return an error to.
+// It has to be deferred directly.
+func recoverTransform(cancel context.CancelCauseFunc) {
+	if recovered := recover(); recovered != nil {
+		cancel(fmt.Errorf("panic: %v", recovered))
+	}
+}
+
+type sequencedItem[T any] struct {
+	index int
+	value T
+	// ok is false for an item whose transform panicked, it only frees its place.
+	ok bool
+}
+
+// transformItemsOrdered numbers the items as they arrive and keeps finished ones
+// in a reorder buffer until every item before them has been sent.
+// With options.Workers > 0 a slot is taken per item and given back only when it is sent,
+// this bounds both the parallelism and the size of the reorder buffer.
+func transformItemsOrdered[In, Out any](
+	ctx context.Context,
+	cancel context.CancelCauseFunc,
+	inputChannel <-chan In,
+	outputChannel chan<- Out,
+	transform func(In) Out,
+	options StageOptions,
+) {
+	var results = make(chan sequencedItem[Out], DefaultBufferSize)
+
+	var slots chan struct{}
+	if options.Workers > 0 {
+		slots = make(chan struct{}, options.Workers)
+	}
+
+	go func() {
+		var waitGroup = &sync.WaitGroup{}
+		var index = 0
+
+		for data := range inputChannel {
+			if slots != nil {
+				slots <- struct{}{}
+			}
+			waitGroup.Add(1)
+
+			var goroutine = func(index int, data In) {
+				var item = sequencedItem[Out]{index: index}
+				defer waitGroup.Done()
+				defer func() { results <- item }()
+				defer recoverTransform(cancel)
+
+				if ctx.Err() == nil {
+					item.value, item.ok = transform(data), true
+				}
+			}
+
+			go goroutine(index, data)
+			index++
+		}
+
+		waitGroup.Wait()
+		close(results)
+	}()
+
+	var pending = map[int]sequencedItem[Out]{}
+	var next = 0
+
+	for result := range results {
+		pending[result.index] = result
+
+		for {
+			var item, ok = pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+
+			if item.ok {
+				sendItem(ctx, outputChannel, item.value, options)
+			}
+			if slots != nil {
+				<-slots
+			}
+			next++
+		}
+	}
 }
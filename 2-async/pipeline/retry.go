@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RetryPolicy decides how often an item is tried before it is given up.
+// The zero value tries every item once without a timeout.
+type RetryPolicy struct {
+	// Attempts is the total number of tries per item, values below 1 mean 1.
+	Attempts int
+	// Timeout limits a single try. A plain function cannot be interrupted,
+	// so a timed out call keeps running in the background and its result is dropped.
+	Timeout time.Duration
+	// InitialBackoff is the pause before the second try, every next pause
+	// is Multiplier times longer, up to MaxBackoff when it is set.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Multiplier defaults to 2.
+	Multiplier float64
+}
+
+func (p RetryPolicy) attempts() int {
+	return max(p.Attempts, 1)
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	var multiplier = p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	var delay = float64(p.InitialBackoff)
+	for range attempt - 1 {
+		delay *= multiplier
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(delay)
+}
+
+// DeadLetter is an item that failed every attempt of a stage.
+type DeadLetter struct {
+	Stage    string
+	Item     interface{}
+	Attempts int
+	Err      error
+}
+
+// TryMap is MapWithOptions for transforms that can fail. Failed tries are repeated
+// according to options.Retry. An item failing every try is sent to options.DeadLetters
+// and skipped, without DeadLetters it fails the whole stage.
+func TryMap[In, Out any](
+	transform func(ctx context.Context, data In) (Out, error),
+	options StageOptions,
+) Stage[In, Out] {
+	return func(ctx context.Context, in <-chan In, out chan<- Out) error {
+		return tryTransformItems(ctx, in, out, transform, options)
+	}
+}
+
+type tryResult[T any] struct {
+	value T
+	ok    bool
+}
+
+func tryTransformItems[In, Out any](
+	ctx context.Context,
+	inputChannel <-chan In,
+	outputChannel chan<- Out,
+	transform func(ctx context.Context, data In) (Out, error),
+	options StageOptions,
+) error {
+	var stageContext, cancel = context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var results = make(chan tryResult[Out])
+
+	// the results are only forwarded below, the failed ones are not sent at all
+	var innerOptions = options
+	if options.Hooks != nil {
+		innerOptions.Hooks = unsentHooks{options.Hooks}
+	}
+
+	go func() {
+		defer close(results)
+
+		var err = transformItems(stageContext, inputChannel, results, func(data In) tryResult[Out] {
+			// after a failure the remaining input is only drained
+			if stageContext.Err() != nil {
+				return tryResult[Out]{}
+			}
+
+			var value, attempts, err = retry(stageContext, data, transform, options.Retry)
+			if err == nil {
+				return tryResult[Out]{value: value, ok: true}
+			}
+			if stageContext.Err() != nil {
+				return tryResult[Out]{}
+			}
+
+			logger().Warn("item failed", "stage", options.Name, "item", data, "attempts", attempts, "error", err)
+
+			if options.DeadLetters == nil && options.dropFailed {
+				return tryResult[Out]{}
+			}
+			if options.DeadLetters == nil {
+				cancel(fmt.Errorf("item %v failed after %d attempts: %w", data, attempts, err))
+				return tryResult[Out]{}
+			}
+
+			SendTyped(stageContext, options.DeadLetters, DeadLetter{
+				Stage:    options.Name,
+				Item:     data,
+				Attempts: attempts,
+				Err:      err,
+			})
+			return tryResult[Out]{}
+		}, innerOptions)
+		if err != nil {
+			cancel(err)
+		}
+	}()
+
+	for result := range results {
+		if result.ok {
+			sendItem(stageContext, outputChannel, result.value, options)
+		}
+	}
+
+	return context.Cause(stageContext)
+}
+
+// retry returns the first successful result and the number of tries it took,
+// or the error of the last try.
+func retry[In, Out any](
+	ctx context.Context,
+	data In,
+	transform func(ctx context.Context, data In) (Out, error),
+	policy RetryPolicy,
+) (Out, int, error) {
+	var value Out
+	var err error
+
+	for attempt := 1; attempt <= policy.attempts(); attempt++ {
+		if attempt > 1 {
+			var timer = time.NewTimer(policy.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return value, attempt - 1, context.Cause(ctx)
+			case <-timer.C:
+			}
+		}
+
+		value, err = tryOnce(ctx, data, transform, policy.Timeout)
+		if err == nil {
+			return value, attempt, nil
+		}
+	}
+
+	return value, policy.attempts(), err
+}
+
+func tryOnce[In, Out any](
+	ctx context.Context,
+	data In,
+	transform func(ctx context.Context, data In) (Out, error),
+	timeout time.Duration,
+) (Out, error) {
+	if timeout <= 0 {
+		return callTransform(ctx, data, transform)
+	}
+
+	var attemptContext, cancel = context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type attemptResult struct {
+		value Out
+		err   error
+	}
+	// buffered, so an abandoned call can still finish
+	var done = make(chan attemptResult, 1)
+
+	go func() {
+		var value, err = callTransform(attemptContext, data, transform)
+		done <- attemptResult{value: value, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-attemptContext.Done():
+		var zero Out
+		if ctx.Err() != nil {
+			return zero, context.Cause(ctx)
+		}
+		return zero, fmt.Errorf("attempt timed out after %s", timeout)
+	}
+}
+
+// callTransform turns a panic of transform into an error, so it can be retried.
+func callTransform[In, Out any](
+	ctx context.Context,
+	data In,
+	transform func(ctx context.Context, data In) (Out, error),
+) (value Out, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	return transform(ctx, data)
+}
+
+// callSigner turns a panic of an external hash function into an error.
+func callSigner(signer func(data string) string, data string) (hash string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("signer failed on '%s': %v", data, recovered)
+		}
+	}()
+
+	return signer(data), nil
+}
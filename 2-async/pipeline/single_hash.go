@@ -1,6 +1,8 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 )
@@ -11,59 +13,117 @@ func SingleHash(
 	dataSignerMd5 func(data string) string,
 	dataSignerCrc32 func(data string) string,
 ) {
-	fmt.Println("SingleHash start")
+	SingleHashWithOptions(inputChannel, outputChannel, dataSignerMd5, dataSignerCrc32, StageOptions{})
+}
 
-	var waitGroup = &sync.WaitGroup{}
-	var mutex = &sync.Mutex{}
+// SingleHashWithOptions is SingleHash with retries, dead letters and options.Workers items in flight.
+func SingleHashWithOptions(
+	inputChannel chan interface{},
+	outputChannel chan interface{},
+	dataSignerMd5 func(data string) string,
+	dataSignerCrc32 func(data string) string,
+	options StageOptions,
+) {
+	logger().Info("stage started", "stage", "SingleHash")
+
+	var md5Limiter = options.md5Limiter()
+
+	if options.Checkpoint != nil {
+		inputChannel = options.Checkpoint.pending(inputChannel)
+	}
 
-	PipelineStage(
+	var err = tryTransformItems(
+		context.Background(),
 		inputChannel,
 		outputChannel,
-		func(data string) string {
-			waitGroup.Add(3)
+		func(ctx context.Context, data interface{}) (interface{}, error) {
+			var key = fmt.Sprintf("%v", data)
+			var result, err = memoized(options.Cache, key, func() (string, error) {
+				return singleHash(ctx, key, dataSignerMd5, dataSignerCrc32, md5Limiter)
+			})
+			return retag(data, result), err
+		},
+		options.named("SingleHash").forJob(),
+	)
+	if err != nil {
+		logger().Error("stage failed", "stage", "SingleHash", "error", err)
+	}
+}
 
-			var crc32HashChannel = make(chan string, 1)
+// SingleHashStage is the typed version of SingleHashWithOptions, any input is hashed in its %v form.
+func SingleHashStage[T any](
+	dataSignerMd5 func(data string) string,
+	dataSignerCrc32 func(data string) string,
+	options StageOptions,
+) Stage[T, string] {
+	var md5Limiter = options.md5Limiter()
+
+	return TryMap(func(ctx context.Context, data T) (string, error) {
+		var key = fmt.Sprintf("%v", data)
+		return memoized(options.Cache, key, func() (string, error) {
+			return singleHash(ctx, key, dataSignerMd5, dataSignerCrc32, md5Limiter)
+		})
+	}, options.named("SingleHash"))
+}
 
-			var md5HashChannel = make(chan string, 1)
-			var crc32Md5HashChannel = make(chan string, 1)
+// md5Limiter allows one dataSignerMd5 call at a time, it overheats when called concurrently.
+func (o StageOptions) md5Limiter() *Limiter {
+	if o.Limiter != nil {
+		return o.Limiter
+	}
+	return NewLimiter(LimiterOptions{Concurrency: 1})
+}
 
-			go func() {
-				defer waitGroup.Done()
+// singleHash computes crc32(data)~crc32(md5(data)), dataSignerMd5 runs only through md5Limiter.
+func singleHash(
+	ctx context.Context,
+	data string,
+	dataSignerMd5 func(data string) string,
+	dataSignerCrc32 func(data string) string,
+	md5Limiter *Limiter,
+) (string, error) {
+	var waitGroup = &sync.WaitGroup{}
+	waitGroup.Add(2)
 
-				var crc32Hash = dataSignerCrc32(data)
-				fmt.Println("SingleHash crc32(data)", crc32Hash)
-				crc32HashChannel <- crc32Hash
-			}()
+	var crc32Hash, crc32Md5Hash string
+	var crc32Err, md5Err error
 
-			go func() {
-				defer waitGroup.Done()
+	go func() {
+		defer waitGroup.Done()
 
-				mutex.Lock()
-				var md5Hash = dataSignerMd5(data)
-				mutex.Unlock()
-				fmt.Println("SingleHash md5(data)", md5Hash)
-				md5HashChannel <- md5Hash
-			}()
+		crc32Hash, crc32Err = callSigner(dataSignerCrc32, data)
+		logger().Debug("SingleHash crc32(data)", "data", data, "hash", crc32Hash)
+	}()
 
-			go func() {
-				defer waitGroup.Done()
+	go func() {
+		defer waitGroup.Done()
 
-				var md5Hash = <-md5HashChannel
-				var crcMd5Hash = dataSignerCrc32(md5Hash)
-				fmt.Println("SingleHash crc32(md5(data))", crcMd5Hash)
-				crc32Md5HashChannel <- crcMd5Hash
-			}()
+		var release, err = md5Limiter.Acquire(ctx)
+		if err != nil {
+			md5Err = err
+			return
+		}
+		md5Hash, err := callSigner(dataSignerMd5, data)
+		release()
+		if err != nil {
+			md5Err = err
+			return
+		}
+		logger().Debug("SingleHash md5(data)", "data", data, "hash", md5Hash)
 
-			waitGroup.Wait()
+		crc32Md5Hash, md5Err = callSigner(dataSignerCrc32, md5Hash)
+		logger().Debug("SingleHash crc32(md5(data))", "data", data, "hash", crc32Md5Hash)
+	}()
 
-			var crc32Hash = <-crc32HashChannel
-			var crc32Md5Hash = <-crc32Md5HashChannel
+	waitGroup.Wait()
 
-			var result = fmt.Sprintf("%s~%s", crc32Hash, crc32Md5Hash)
-			fmt.Println("SingleHash result", result)
-			fmt.Println()
+	var err = errors.Join(crc32Err, md5Err)
+	if err != nil {
+		return "", err
+	}
 
-			return result
-		},
-	)
+	var result = fmt.Sprintf("%s~%s", crc32Hash, crc32Md5Hash)
+	logger().Debug("SingleHash result", "data", data, "result", result)
+
+	return result, nil
 }
@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Stage is the typed counterpart of ContextJob. It reads from in until it is closed
+// and writes results to out, closing out is up to whoever runs the stage.
+type Stage[In, Out any] func(ctx context.Context, in <-chan In, out chan<- Out) error
+
+// Then connects the output of first to the input of second. The resulting stage
+// fails with the first error of either of them, cancelling the other one.
+func Then[A, B, C any](first Stage[A, B], second Stage[B, C]) Stage[A, C] {
+	return ThenWithOptions(first, second, StageOptions{})
+}
+
+// ThenWithOptions is Then with options.BufferSize items between first and second.
+func ThenWithOptions[A, B, C any](first Stage[A, B], second Stage[B, C], options StageOptions) Stage[A, C] {
+	return func(ctx context.Context, in <-chan A, out chan<- C) error {
+		var stageContext, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		var middle = make(chan B, options.bufferSize())
+		var waitGroup = &sync.WaitGroup{}
+		waitGroup.Add(2)
+
+		go func() {
+			defer waitGroup.Done()
+			defer close(middle)
+
+			var err = runStage(stageContext, first, in, middle)
+			if err != nil {
+				cancel(err)
+			}
+		}()
+
+		go func() {
+			defer waitGroup.Done()
+			defer drain(middle)
+
+			var err = runStage(stageContext, second, middle, out)
+			if err != nil {
+				cancel(err)
+			}
+		}()
+
+		waitGroup.Wait()
+		return context.Cause(stageContext)
+	}
+}
+
+// Map turns a plain function into a stage, items are transformed in parallel
+// and leave in completion order, just like with PipelineStage.
+func Map[In, Out any](transform func(In) Out) Stage[In, Out] {
+	return MapWithOptions(transform, StageOptions{})
+}
+
+// MapWithOptions is Map with at most options.Workers transforms in flight.
+func MapWithOptions[In, Out any](transform func(In) Out, options StageOptions) Stage[In, Out] {
+	return func(ctx context.Context, in <-chan In, out chan<- Out) error {
+		return transformItems(ctx, in, out, transform, options)
+	}
+}
+
+// SendTyped writes value to out unless ctx is cancelled first.
+func SendTyped[T any](ctx context.Context, out chan<- T, value T) error {
+	select {
+	case out <- value:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Run feeds inputs to stage and collects everything it produces.
+func Run[In, Out any](ctx context.Context, stage Stage[In, Out], inputs []In) ([]Out, error) {
+	var in = make(chan In, len(inputs))
+	for _, input := range inputs {
+		in <- input
+	}
+	close(in)
+
+	var out = make(chan Out, DefaultBufferSize)
+	var results = make([]Out, 0, len(inputs))
+	var done = make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for result := range out {
+			results = append(results, result)
+		}
+	}()
+
+	var err = runStage(ctx, stage, in, out)
+	close(out)
+	<-done
+
+	return results, err
+}
+
+// StageFromJob wraps an untyped Job, values are moved between the typed
+// and untyped channels by two helper goroutines. The channels of the job are unbuffered,
+// so only the channels around the stage hold items.
+func StageFromJob(job Job) Stage[interface{}, interface{}] {
+	return func(ctx context.Context, in <-chan interface{}, out chan<- interface{}) error {
+		var jobInput = make(chan interface{})
+		var jobOutput = make(chan interface{})
+		var waitGroup = &sync.WaitGroup{}
+		waitGroup.Add(2)
+
+		go func() {
+			defer waitGroup.Done()
+			defer close(jobInput)
+
+			for data := range in {
+				jobInput <- data
+			}
+		}()
+
+		go func() {
+			defer waitGroup.Done()
+			defer drain(jobOutput)
+
+			for data := range jobOutput {
+				if SendTyped(ctx, out, data) != nil {
+					return
+				}
+			}
+		}()
+
+		job(jobInput, jobOutput)
+		close(jobOutput)
+		drain(jobInput)
+
+		waitGroup.Wait()
+		return context.Cause(ctx)
+	}
+}
+
+// ContextJob lets a typed stage run inside ExecutePipelineContext.
+// A value of an unexpected type fails the pipeline instead of being converted.
+// The typed channels are unbuffered, the pipeline channels alone decide the buffering.
+func (s Stage[In, Out]) ContextJob() ContextJob {
+	return func(ctx context.Context, in, out chan interface{}) error {
+		var stageContext, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		var typedInput = make(chan In)
+		var typedOutput = make(chan Out)
+		var waitGroup = &sync.WaitGroup{}
+		waitGroup.Add(2)
+
+		go func() {
+			defer waitGroup.Done()
+			defer close(typedInput)
+
+			for data := range in {
+				var value, ok = data.(In)
+				if !ok {
+					cancel(fmt.Errorf("unexpected input %v of type %T", data, data))
+					return
+				}
+				if SendTyped(stageContext, typedInput, value) != nil {
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer waitGroup.Done()
+
+			for data := range typedOutput {
+				if Send(stageContext, out, data) != nil {
+					drain(typedOutput)
+					return
+				}
+			}
+		}()
+
+		var err = runStage(stageContext, s, typedInput, typedOutput)
+		if err != nil {
+			cancel(err)
+		}
+		close(typedOutput)
+		drain(typedInput)
+
+		waitGroup.Wait()
+		return context.Cause(stageContext)
+	}
+}
+
+// Job lets a typed stage run inside ExecutePipeline.
+func (s Stage[In, Out]) Job() Job {
+	return func(in, out chan interface{}) {
+		var err = s.ContextJob()(context.Background(), in, out)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func runStage[In, Out any](
+	ctx context.Context,
+	stage Stage[In, Out],
+	in <-chan In,
+	out chan<- Out,
+) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	return stage(ctx, in, out)
+}
+
+func drain[T any](channel <-chan T) {
+	for range channel {
+	}
+}
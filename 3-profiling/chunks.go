@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mailru/easyjson"
+	"io"
+	"stepikGoWebServices/model"
+	"strings"
+)
+
+// DefaultChunkSize is the approximate number of bytes a worker scans at once.
+const DefaultChunkSize = 4 * 1024 * 1024 // 4 mb
+
+const maxLineSize = 100 * 1024 // 100 kb
+
+// fileChunk is a byte range of whole lines.
+type fileChunk struct {
+	start int64
+	end   int64
+}
+
+// splitChunks cuts [0, size) into chunks of about chunkSize bytes,
+// every chunk but the last one ends right after a newline.
+func splitChunks(file io.ReaderAt, size int64, chunkSize int64) ([]fileChunk, error) {
+	var chunks = make([]fileChunk, 0, size/chunkSize+1)
+	var buffer = make([]byte, 4096)
+
+	for start := int64(0); start < size; {
+		var end = start + chunkSize
+
+		for end < size {
+			var read, err = file.ReadAt(buffer, end)
+			var newline = bytes.IndexByte(buffer[:read], '\n')
+			if newline >= 0 {
+				end += int64(newline) + 1
+				break
+			}
+			end += int64(read)
+
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		end = min(end, size)
+		chunks = append(chunks, fileChunk{start: start, end: end})
+		start = end
+	}
+
+	return chunks, nil
+}
+
+type userMatch struct {
+	// line is counted from the start of the chunk.
+	line  int
+	name  string
+	email string
+}
+
+type chunkResult struct {
+	// lines is the number of lines scanned, with err set the line that failed.
+	lines    int
+	matches  []userMatch
+	browsers map[string]struct{}
+	err      error
+}
+
+// userSearch is what every worker needs to evaluate lines.
+type userSearch struct {
+	query          Query
+	targetBrowsers []*condition
+	emailAt        string
+	easyJSON       bool
+}
+
+// scanLine evaluates one line, view is the decoding state of the calling goroutine.
+func (s *userSearch) scanLine(line []byte, lineNumber int, view *userView, result *chunkResult) error {
+	if s.easyJSON {
+		var user = model.User{}
+		var err = easyjson.Unmarshal(line, &user)
+		if err != nil {
+			return err
+		}
+
+		s.scanUser(&user, lineNumber, result)
+		return nil
+	}
+
+	var err = view.decode(line, len(s.targetBrowsers) != 0)
+	if err != nil {
+		return err
+	}
+
+	s.countViewBrowsers(view, result.browsers)
+	if s.query.matchView(view) {
+		result.matches = append(result.matches, s.matchView(view, lineNumber))
+	}
+	return nil
+}
+
+// scanUser evaluates a user already decoded.
+func (s *userSearch) scanUser(user *model.User, lineNumber int, result *chunkResult) {
+	s.countBrowsers(user, result.browsers)
+	if s.query.Match(user) {
+		result.matches = append(result.matches, s.match(user, lineNumber))
+	}
+}
+
+func (s *userSearch) scanChunk(file io.ReaderAt, chunk fileChunk) chunkResult {
+	return s.scanReader(io.NewSectionReader(file, chunk.start, chunk.end-chunk.start))
+}
+
+// scanReader scans JSON lines.
+func (s *userSearch) scanReader(reader io.Reader) chunkResult {
+	var scanner = bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, maxLineSize), maxLineSize)
+
+	var result = chunkResult{browsers: map[string]struct{}{}}
+	var view = &userView{}
+
+	for ; scanner.Scan(); result.lines++ {
+		var err = s.scanLine(scanner.Bytes(), result.lines, view, &result)
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	result.err = scanner.Err()
+	return result
+}
+
+// countBrowsers adds the browsers of user satisfying a browsers condition to seen.
+func (s *userSearch) countBrowsers(user *model.User, seen map[string]struct{}) {
+	for _, browser := range user.Browsers {
+		if len(browser) != 0 {
+			for _, targetBrowser := range s.targetBrowsers {
+				if targetBrowser.matchValue(browser) {
+					seen[browser] = struct{}{}
+					break
+				}
+			}
+		}
+	}
+}
+
+// countViewBrowsers is countBrowsers for a view, it allocates only for a browser seen for the first time.
+func (s *userSearch) countViewBrowsers(view *userView, seen map[string]struct{}) {
+	for i := range view.browsers {
+		var browser = view.browsers[i].bytes()
+		if len(browser) == 0 {
+			continue
+		}
+		if _, ok := seen[string(browser)]; ok {
+			continue
+		}
+
+		for _, targetBrowser := range s.targetBrowsers {
+			if targetBrowser.matchBytes(browser) {
+				seen[string(browser)] = struct{}{}
+				break
+			}
+		}
+	}
+}
+
+func (s *userSearch) matchView(view *userView, line int) userMatch {
+	var email = string(view.field(fieldEmail))
+	if s.emailAt != "" {
+		email = strings.ReplaceAll(email, "@", s.emailAt)
+	}
+	return userMatch{line: line, name: string(view.field(fieldName)), email: email}
+}
+
+func (s *userSearch) match(user *model.User, line int) userMatch {
+	var email = user.Email
+	if s.emailAt != "" {
+		email = strings.ReplaceAll(email, "@", s.emailAt)
+	}
+	return userMatch{line: line, name: user.Name, email: email}
+}
+
+// scanChunks scans the chunks on a pool of workers. The result of chunk i arrives
+// on the i-th channel, so they can be merged in file order while later chunks are still scanned.
+// Closing done stops the workers after their current chunk.
+func (s *userSearch) scanChunks(file io.ReaderAt, chunks []fileChunk, workers int, done <-chan struct{}) []chan chunkResult {
+	var results = make([]chan chunkResult, len(chunks))
+	for i := range results {
+		results[i] = make(chan chunkResult, 1)
+	}
+
+	var indexes = make(chan int)
+	go func() {
+		defer close(indexes)
+
+		for i := range chunks {
+			select {
+			case indexes <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for range min(workers, len(chunks)) {
+		go func() {
+			for i := range indexes {
+				results[i] <- s.scanChunk(file, chunks[i])
+			}
+		}()
+	}
+
+	return results
+}
+
+func writeChunkMatches(out io.Writer, result chunkResult, firstLine int) {
+	for _, match := range result.matches {
+		fmt.Fprintf(out, "[%d] %s <%s>\n", firstLine+match.line, match.name, match.email)
+	}
+}
@@ -1,68 +1,156 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"github.com/mailru/easyjson"
 	"io"
 	"os"
-	"regexp"
-	"stepikGoWebServices/model"
-	"strings"
+	"runtime"
 )
 
+// DefaultEmailAt replaces "@" in the reported emails.
+const DefaultEmailAt = " [at] "
+
+type SearchOptions struct {
+	FilePath string
+	// Query selects the reported users, see Query for the syntax.
+	Query string
+	// EmailAt replaces "@" in the reported emails, empty keeps them as they are.
+	EmailAt string
+	// Workers is the number of goroutines scanning the file, 0 uses every CPU.
+	Workers int
+	// ChunkSize is the number of bytes scanned by a worker at once, 0 means DefaultChunkSize.
+	ChunkSize int64
+	// IndexPath enables the index of FilePath, it is built or rebuilt when needed.
+	// Queries the index cannot narrow down, e.g. with NOT or matches, still scan the whole file.
+	IndexPath string
+	// Decoder is DecoderStream, the default, or DecoderEasyJSON.
+	Decoder string
+	// Format is FormatJSON, FormatCSV or FormatMsgpack, empty detects it.
+	// Compressed and non-JSON inputs are read sequentially, without workers or index.
+	Format string
+}
+
+const (
+	// DecoderStream reads only the fields the query needs straight from the line,
+	// without allocating per line.
+	DecoderStream = "stream"
+	// DecoderEasyJSON decodes every line into a model.User.
+	DecoderEasyJSON = "easyjson"
+)
+
+func DefaultSearchOptions() SearchOptions {
+	return SearchOptions{
+		FilePath: filePath,
+		Query:    DefaultQuery,
+		EmailAt:  DefaultEmailAt,
+	}
+}
+
+func (o SearchOptions) workers() int {
+	if o.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.Workers
+}
+
+func (o SearchOptions) chunkSize() int64 {
+	if o.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return o.ChunkSize
+}
+
 func FastSearch(out io.Writer) {
-	var file, err = os.Open(filePath)
+	var err = FastSearchWithOptions(out, DefaultSearchOptions())
 	if err != nil {
 		panic(err)
 	}
+}
 
-	var scanner = bufio.NewScanner(file)
+// FastSearchWithOptions reports the users matching options.Query and the number
+// of unique browsers satisfying any browsers condition of the query, among all users.
+// A plain JSON lines file is scanned in chunks by options.Workers goroutines, the output
+// is the same as with a single one. Gzip and zstd compression are detected and undone.
+func FastSearchWithOptions(out io.Writer, options SearchOptions) error {
+	var query, err = ParseQuery(options.Query)
+	if err != nil {
+		return err
+	}
+	if options.Decoder != "" && options.Decoder != DecoderStream && options.Decoder != DecoderEasyJSON {
+		return fmt.Errorf("unknown decoder '%s', expected %s or %s", options.Decoder, DecoderStream, DecoderEasyJSON)
+	}
+	var search = &userSearch{
+		query:          query,
+		targetBrowsers: browserConditions(query),
+		emailAt:        options.EmailAt,
+		easyJSON:       options.Decoder == DecoderEasyJSON,
+	}
 
-	const bufferSize = 100 * 1024 // 100 kb
-	var scannerBuffer = make([]byte, bufferSize)
-	scanner.Buffer(scannerBuffer, bufferSize)
+	file, err := os.Open(options.FilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	var targetBrowsers = []string{
-		"Android",
-		"MSIE",
+	info, err := file.Stat()
+	if err != nil {
+		return err
 	}
-	var seenBrowsers = make(map[string]interface{})
 
-	var reg = regexp.MustCompile("@")
+	input, err := openInput(file, options.Format)
+	if err != nil {
+		return err
+	}
+	defer input.close()
 
-	fmt.Fprintln(out, "found users:")
+	var done = make(chan struct{})
+	defer close(done)
+
+	var results []chan chunkResult
+	if !input.plain() {
+		results = []chan chunkResult{make(chan chunkResult, 1)}
+		results[0] <- search.scanInput(input)
+	}
 
-	for i := 0; scanner.Scan(); i++ {
-		var line = scanner.Bytes()
-		var user = model.User{}
-		var err = easyjson.Unmarshal(line, &user)
+	if results == nil && options.IndexPath != "" {
+		var index, err = openIndex(options.FilePath, options.IndexPath)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		var matchedBrowsers = make(map[string]interface{}, len(targetBrowsers))
-
-		for _, browser := range user.Browsers {
-			if len(browser) != 0 {
-				for _, targetBrowser := range targetBrowsers {
-					if strings.Contains(browser, targetBrowser) {
-						matchedBrowsers[targetBrowser] = struct{}{}
-						seenBrowsers[browser] = struct{}{}
-					}
-				}
-			}
+		var lines, ok = index.plan(search)
+		if ok {
+			results = []chan chunkResult{make(chan chunkResult, 1)}
+			results[0] <- search.scanLines(file, index, lines)
 		}
+	}
 
-		if len(matchedBrowsers) != len(targetBrowsers) {
-			continue
+	if results == nil {
+		var chunks, err = splitChunks(file, info.Size(), options.chunkSize())
+		if err != nil {
+			return err
 		}
+		results = search.scanChunks(file, chunks, options.workers(), done)
+	}
+
+	var seenBrowsers = make(map[string]struct{})
+	var firstLine = 0
 
-		//log.Println("Android and MSIE user:", user["name"], user["email"])
-		var email = reg.ReplaceAllString(user.Email, " [at] ")
+	fmt.Fprintln(out, "found users:")
+
+	for _, resultChannel := range results {
+		var result = <-resultChannel
+		if result.err != nil {
+			return fmt.Errorf("line %d: %w", firstLine+result.lines, result.err)
+		}
 
-		fmt.Fprintf(out, "[%d] %s <%s>\n", i, user.Name, email)
+		writeChunkMatches(out, result, firstLine)
+		for browser := range result.browsers {
+			seenBrowsers[browser] = struct{}{}
+		}
+		firstLine += result.lines
 	}
 
 	fmt.Fprintln(out, "\nTotal unique browsers", len(seenBrowsers))
+	return nil
 }
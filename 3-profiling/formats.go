@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"stepikGoWebServices/model"
+)
+
+const (
+	// FormatJSON is one JSON object per line.
+	FormatJSON = "json"
+	// FormatCSV has a header row naming the fields, browsers hold a JSON array of strings.
+	FormatCSV = "csv"
+	// FormatMsgpack is a sequence of MessagePack maps.
+	FormatMsgpack = "msgpack"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// userInput is the decompressed users file with its format.
+type userInput struct {
+	reader     *bufio.Reader
+	format     string
+	compressed bool
+	closers    []func()
+}
+
+// openInput detects gzip and zstd compression by their magic numbers and then the format
+// by the first byte: '{' starts JSON lines, a map header starts MessagePack, anything else is CSV.
+// An explicit format skips the second detection.
+func openInput(source io.Reader, format string) (*userInput, error) {
+	var input = &userInput{reader: bufio.NewReaderSize(source, maxLineSize)}
+
+	var magic, _ = input.reader.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		var decompressor, err = gzip.NewReader(input.reader)
+		if err != nil {
+			return nil, err
+		}
+		input.closers = append(input.closers, func() { decompressor.Close() })
+		input.reader = bufio.NewReaderSize(decompressor, maxLineSize)
+		input.compressed = true
+	case bytes.HasPrefix(magic, zstdMagic):
+		var decompressor, err = zstd.NewReader(input.reader)
+		if err != nil {
+			return nil, err
+		}
+		input.closers = append(input.closers, decompressor.Close)
+		input.reader = bufio.NewReaderSize(decompressor, maxLineSize)
+		input.compressed = true
+	}
+
+	switch format {
+	case "":
+		input.format = input.detectFormat()
+	case FormatJSON, FormatCSV, FormatMsgpack:
+		input.format = format
+	default:
+		input.close()
+		return nil, fmt.Errorf("unknown format '%s', expected %s, %s or %s", format, FormatJSON, FormatCSV, FormatMsgpack)
+	}
+
+	return input, nil
+}
+
+func (i *userInput) detectFormat() string {
+	for offset := 1; ; offset++ {
+		var head, _ = i.reader.Peek(offset)
+		if len(head) < offset {
+			// empty or blank, nothing to decode either way
+			return FormatJSON
+		}
+
+		var first = head[offset-1]
+		switch {
+		case first == ' ' || first == '\t' || first == '\r' || first == '\n':
+			continue
+		case first == '{':
+			return FormatJSON
+		case first>>4 == 0x8 || first == 0xde || first == 0xdf:
+			return FormatMsgpack
+		default:
+			return FormatCSV
+		}
+	}
+}
+
+// plain tells whether the input is the file itself, which can be split into chunks and indexed.
+func (i *userInput) plain() bool {
+	return !i.compressed && i.format == FormatJSON
+}
+
+func (i *userInput) close() {
+	for _, closer := range i.closers {
+		closer()
+	}
+}
+
+// userDecoder reads the users of a format other than JSON lines one by one, io.EOF ends them.
+type userDecoder interface {
+	decode(user *model.User) error
+}
+
+// scanInput scans an input that is not plain, sequentially.
+func (s *userSearch) scanInput(input *userInput) chunkResult {
+	var decoder userDecoder
+	switch input.format {
+	case FormatCSV:
+		decoder = newCSVDecoder(input.reader)
+	case FormatMsgpack:
+		decoder = &msgpackDecoder{reader: input.reader}
+	default:
+		return s.scanReader(input.reader)
+	}
+
+	var result = chunkResult{browsers: map[string]struct{}{}}
+
+	for ; ; result.lines++ {
+		var user = model.User{}
+		var err = decoder.decode(&user)
+		if errors.Is(err, io.EOF) {
+			return result
+		}
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		s.scanUser(&user, result.lines, &result)
+	}
+}
+
+type csvDecoder struct {
+	reader  *csv.Reader
+	columns []string
+	err     error
+}
+
+func newCSVDecoder(reader io.Reader) *csvDecoder {
+	var decoder = &csvDecoder{reader: csv.NewReader(reader)}
+	decoder.reader.ReuseRecord = true
+
+	var header, err = decoder.reader.Read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		decoder.err = fmt.Errorf("csv header: %w", err)
+	}
+	// the record is reused, the names must survive the next read
+	decoder.columns = append(decoder.columns, header...)
+	return decoder
+}
+
+// decode ignores unknown columns like unknown JSON fields are ignored.
+func (d *csvDecoder) decode(user *model.User) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	var record, err = d.reader.Read()
+	if err != nil {
+		return err
+	}
+
+	for i, value := range record {
+		switch d.columns[i] {
+		case "browsers":
+			if value != "" {
+				err = json.Unmarshal([]byte(value), &user.Browsers)
+				if err != nil {
+					return fmt.Errorf("browsers must be a JSON array of strings: %w", err)
+				}
+			}
+		case "company":
+			user.Company = value
+		case "email":
+			user.Email = value
+		case "job":
+			user.Job = value
+		case "name":
+			user.Name = value
+		case "phone":
+			user.Phone = value
+		}
+	}
+	return nil
+}
+
+// msgpackDecoder reads MessagePack maps, only the parts of the format users need are
+// decoded, any other value is skipped.
+type msgpackDecoder struct {
+	reader *bufio.Reader
+}
+
+func (d *msgpackDecoder) decode(user *model.User) error {
+	var kind, err = d.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	size, err := d.mapSize(kind)
+	if err != nil {
+		return err
+	}
+
+	for range size {
+		var key, err = d.readString()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "browsers":
+			user.Browsers, err = d.readStrings()
+		case "company":
+			user.Company, err = d.readString()
+		case "email":
+			user.Email, err = d.readString()
+		case "job":
+			user.Job, err = d.readString()
+		case "name":
+			user.Name, err = d.readString()
+		case "phone":
+			user.Phone, err = d.readString()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return fmt.Errorf("msgpack field '%s': %w", key, err)
+		}
+	}
+	return nil
+}
+
+// unexpectedEOF reports an input ending inside a record.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *msgpackDecoder) mapSize(kind byte) (int, error) {
+	switch {
+	case kind>>4 == 0x8:
+		return int(kind & 0x0f), nil
+	case kind == 0xde:
+		return d.readSize(2)
+	case kind == 0xdf:
+		return d.readSize(4)
+	default:
+		return 0, fmt.Errorf("msgpack: expected a map, got type 0x%02x", kind)
+	}
+}
+
+func (d *msgpackDecoder) readSize(width int) (int, error) {
+	var size = 0
+	for range width {
+		var next, err = d.reader.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		size = size<<8 | int(next)
+	}
+	return size, nil
+}
+
+// readString accepts str and bin values, nil is an empty string.
+func (d *msgpackDecoder) readString() (string, error) {
+	var kind, err = d.reader.ReadByte()
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	var size int
+	switch {
+	case kind == 0xc0:
+		return "", nil
+	case kind>>5 == 0x5:
+		size = int(kind & 0x1f)
+	case kind == 0xd9 || kind == 0xc4:
+		size, err = d.readSize(1)
+	case kind == 0xda || kind == 0xc5:
+		size, err = d.readSize(2)
+	case kind == 0xdb || kind == 0xc6:
+		size, err = d.readSize(4)
+	default:
+		return "", fmt.Errorf("msgpack: expected a string, got type 0x%02x", kind)
+	}
+	if err != nil {
+		return "", err
+	}
+	// the size comes from the input, a corrupt one must not allocate gigabytes
+	if size > maxLineSize {
+		return "", fmt.Errorf("msgpack: string of %d bytes, at most %d expected", size, maxLineSize)
+	}
+
+	var value = make([]byte, size)
+	_, err = io.ReadFull(d.reader, value)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(value), nil
+}
+
+func (d *msgpackDecoder) readStrings() ([]string, error) {
+	var kind, err = d.reader.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	var size int
+	switch {
+	case kind == 0xc0:
+		return nil, nil
+	case kind>>4 == 0x9:
+		size = int(kind & 0x0f)
+	case kind == 0xdc:
+		size, err = d.readSize(2)
+	case kind == 0xdd:
+		size, err = d.readSize(4)
+	default:
+		return nil, fmt.Errorf("msgpack: expected an array, got type 0x%02x", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// grown as elements arrive, a corrupt size fails at the end of the input instead
+	var values []string
+	for range size {
+		var value, err = d.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// skip reads a value of any type and throws it away. The elements of maps and arrays
+// are counted instead of recursed into, so no nesting depth can exhaust the stack.
+func (d *msgpackDecoder) skip() error {
+	for pending := 1; pending > 0; pending-- {
+		var err = d.skipHeader(&pending)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipHeader skips one value without its elements, which are added to pending.
+func (d *msgpackDecoder) skipHeader(pending *int) error {
+	var kind, err = d.reader.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	var payload, elements int
+	switch {
+	case kind <= 0x7f || kind >= 0xe0 || kind == 0xc0 || kind == 0xc2 || kind == 0xc3:
+		// fixint, nil and bool carry no payload
+	case kind>>4 == 0x8:
+		elements = 2 * int(kind&0x0f)
+	case kind>>4 == 0x9:
+		elements = int(kind & 0x0f)
+	case kind>>5 == 0x5:
+		payload = int(kind & 0x1f)
+	case kind == 0xcc || kind == 0xd0:
+		payload = 1
+	case kind == 0xcd || kind == 0xd1:
+		payload = 2
+	case kind == 0xca || kind == 0xce || kind == 0xd2:
+		payload = 4
+	case kind == 0xcb || kind == 0xcf || kind == 0xd3:
+		payload = 8
+	case kind >= 0xd4 && kind <= 0xd8:
+		// fixext: a type byte and 1, 2, 4, 8 or 16 bytes of data
+		payload = 1 + 1<<(kind-0xd4)
+	case kind == 0xc4 || kind == 0xd9:
+		payload, err = d.readSize(1)
+	case kind == 0xc5 || kind == 0xda:
+		payload, err = d.readSize(2)
+	case kind == 0xc6 || kind == 0xdb:
+		payload, err = d.readSize(4)
+	case kind == 0xc7:
+		payload, err = d.readSize(1)
+		payload++
+	case kind == 0xc8:
+		payload, err = d.readSize(2)
+		payload++
+	case kind == 0xc9:
+		payload, err = d.readSize(4)
+		payload++
+	case kind == 0xdc:
+		elements, err = d.readSize(2)
+	case kind == 0xdd:
+		elements, err = d.readSize(4)
+	case kind == 0xde:
+		elements, err = d.readSize(2)
+		elements *= 2
+	case kind == 0xdf:
+		elements, err = d.readSize(4)
+		elements *= 2
+	default:
+		return fmt.Errorf("msgpack: unknown type 0x%02x", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = d.reader.Discard(payload)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	*pending += elements
+	return nil
+}
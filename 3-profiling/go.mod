@@ -2,6 +2,9 @@ module stepikGoWebServices
 
 go 1.23
 
-require github.com/mailru/easyjson v0.9.0
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/mailru/easyjson v0.9.0
+)
 
 require github.com/josharian/intern v1.0.0 // indirect
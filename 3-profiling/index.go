@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/mailru/easyjson"
+	"io"
+	"os"
+	"slices"
+	"stepikGoWebServices/model"
+	"strings"
+	"unicode"
+)
+
+const indexVersion = 1
+
+// searchIndex maps the words of every field to the lines containing them, and every line
+// to its offset, so a query can read only the lines that may match it.
+// A word is a maximal run of letters and digits.
+type searchIndex struct {
+	Version     int
+	DataSize    int64
+	DataModTime int64
+	// Offsets[i] is where line i starts, the last element is the end of the data.
+	Offsets []int64
+	// Postings maps field + ":" + word to the ascending numbers of the lines having it.
+	Postings map[string][]int32
+}
+
+// BuildIndex indexes the users of dataPath and writes the index to indexPath.
+func BuildIndex(dataPath string, indexPath string) error {
+	var index, err = buildIndex(dataPath)
+	if err != nil {
+		return err
+	}
+	return index.save(indexPath)
+}
+
+// openIndex loads the index of dataPath, building it again when it is missing
+// or was built for another version of the data.
+func openIndex(dataPath string, indexPath string) (*searchIndex, error) {
+	var info, err = os.Stat(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var index = &searchIndex{}
+	file, err := os.Open(indexPath)
+	if err == nil {
+		err = gob.NewDecoder(bufio.NewReader(file)).Decode(index)
+		file.Close()
+	}
+
+	if err == nil && index.Version == indexVersion &&
+		index.DataSize == info.Size() && index.DataModTime == info.ModTime().UnixNano() {
+		return index, nil
+	}
+
+	err = BuildIndex(dataPath, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	return openIndex(dataPath, indexPath)
+}
+
+func buildIndex(dataPath string) (*searchIndex, error) {
+	var file, err = os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var index = &searchIndex{
+		Version:     indexVersion,
+		DataSize:    info.Size(),
+		DataModTime: info.ModTime().UnixNano(),
+		Offsets:     []int64{0},
+		Postings:    map[string][]int32{},
+	}
+
+	var reader = bufio.NewReaderSize(file, maxLineSize)
+	var offset int64
+
+	for line := int32(0); ; line++ {
+		var data, err = reader.ReadSlice('\n')
+		if errors.Is(err, io.EOF) && len(data) == 0 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		offset += int64(len(data))
+		index.Offsets = append(index.Offsets, offset)
+
+		var user = model.User{}
+		err = easyjson.Unmarshal(trimLine(data), &user)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		for _, browser := range user.Browsers {
+			index.addWords("browsers", browser, line)
+		}
+		index.addWords("company", user.Company, line)
+		index.addWords("email", user.Email, line)
+		index.addWords("job", user.Job, line)
+		index.addWords("name", user.Name, line)
+		index.addWords("phone", user.Phone, line)
+	}
+
+	return index, nil
+}
+
+// addWords relies on lines being added in order, a word seen twice on a line is stored once.
+func (index *searchIndex) addWords(field string, value string, line int32) {
+	for _, word := range strings.FieldsFunc(value, isNotWordRune) {
+		var key = field + ":" + word
+		var lines = index.Postings[key]
+		if len(lines) == 0 || lines[len(lines)-1] != line {
+			index.Postings[key] = append(lines, line)
+		}
+	}
+}
+
+func (index *searchIndex) save(indexPath string) error {
+	// written aside and renamed, so a reader never sees half an index
+	var temporaryPath = indexPath + ".tmp"
+	var file, err = os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+
+	var writer = bufio.NewWriter(file)
+	err = gob.NewEncoder(writer).Encode(index)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return fmt.Errorf("failed to write index '%s', error %s", indexPath, err)
+	}
+
+	return os.Rename(temporaryPath, indexPath)
+}
+
+func isNotWordRune(char rune) bool {
+	return !unicode.IsLetter(char) && !unicode.IsDigit(char)
+}
+
+// candidates returns the lines that may match query in ascending order,
+// ok is false when the index cannot narrow the query down.
+//
+// A value containing a word w can only be found on lines with a word containing w,
+// as w cannot span two words of the value. Its longest word is used, as the most selective one.
+func (index *searchIndex) candidates(query Query) (lines []int32, ok bool) {
+	switch query := query.(type) {
+	case andQuery:
+		var left, leftOk = index.candidates(query.left)
+		var right, rightOk = index.candidates(query.right)
+		switch {
+		case leftOk && rightOk:
+			return intersectLines(left, right), true
+		case leftOk:
+			return left, true
+		default:
+			return right, rightOk
+		}
+	case orQuery:
+		var left, leftOk = index.candidates(query.left)
+		var right, rightOk = index.candidates(query.right)
+		if !leftOk || !rightOk {
+			return nil, false
+		}
+		return unionLines(left, right), true
+	case *condition:
+		if query.operator == "matches" {
+			return nil, false
+		}
+
+		var words = strings.FieldsFunc(query.value, isNotWordRune)
+		if len(words) == 0 {
+			return nil, false
+		}
+		var longest = slices.MaxFunc(words, func(a, b string) int { return len(a) - len(b) })
+
+		var prefix = query.field + ":"
+		for key, keyLines := range index.Postings {
+			if strings.HasPrefix(key, prefix) && strings.Contains(key[len(prefix):], longest) {
+				lines = unionLines(lines, keyLines)
+			}
+		}
+		return lines, true
+	default:
+		// a negation matches every line not matching, which the index does not know
+		return nil, false
+	}
+}
+
+// plan returns the lines search has to read, those that may match its query
+// and those that may have a browser it counts.
+func (index *searchIndex) plan(search *userSearch) ([]int32, bool) {
+	var lines, ok = index.candidates(search.query)
+	if !ok {
+		return nil, false
+	}
+
+	for _, targetBrowser := range search.targetBrowsers {
+		var browserLines, ok = index.candidates(targetBrowser)
+		if !ok {
+			return nil, false
+		}
+		lines = unionLines(lines, browserLines)
+	}
+	return lines, true
+}
+
+// scanLines is scanChunk for the given lines only, which are read directly at their offsets.
+func (s *userSearch) scanLines(file io.ReaderAt, index *searchIndex, lines []int32) chunkResult {
+	var result = chunkResult{lines: len(index.Offsets) - 1, browsers: map[string]struct{}{}}
+	var buffer = make([]byte, 0, maxLineSize)
+	var view = &userView{}
+
+	for _, line := range lines {
+		var start, end = index.Offsets[line], index.Offsets[line+1]
+		buffer = slices.Grow(buffer[:0], int(end-start))[:end-start]
+
+		var _, err = file.ReadAt(buffer, start)
+		if err == nil || errors.Is(err, io.EOF) {
+			err = s.scanLine(trimLine(buffer), int(line), view, &result)
+		}
+		if err != nil {
+			result.lines, result.err = int(line), err
+			return result
+		}
+	}
+
+	return result
+}
+
+// unionLines merges two ascending lists of lines.
+func unionLines(left []int32, right []int32) []int32 {
+	var result = make([]int32, 0, len(left)+len(right))
+
+	for len(left) != 0 && len(right) != 0 {
+		switch {
+		case left[0] < right[0]:
+			result, left = append(result, left[0]), left[1:]
+		case left[0] > right[0]:
+			result, right = append(result, right[0]), right[1:]
+		default:
+			result, left, right = append(result, left[0]), left[1:], right[1:]
+		}
+	}
+
+	result = append(result, left...)
+	return append(result, right...)
+}
+
+// intersectLines keeps the lines present in both ascending lists.
+func intersectLines(left []int32, right []int32) []int32 {
+	var result = make([]int32, 0, min(len(left), len(right)))
+
+	for len(left) != 0 && len(right) != 0 {
+		switch {
+		case left[0] < right[0]:
+			left = left[1:]
+		case left[0] > right[0]:
+			right = right[1:]
+		default:
+			result, left, right = append(result, left[0]), left[1:], right[1:]
+		}
+	}
+
+	return result
+}
+
+func trimLine(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
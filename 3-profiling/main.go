@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	var options = DefaultSearchOptions()
+
+	flag.StringVar(&options.FilePath, "file", options.FilePath, "users file, JSON lines, CSV or MessagePack, optionally gzip or zstd compressed")
+	flag.StringVar(
+		&options.Query,
+		"query",
+		options.Query,
+		`users to report, e.g. 'company equals "Flashpoint" AND NOT job contains "Analyst"'`,
+	)
+	flag.StringVar(&options.EmailAt, "email-at", options.EmailAt, `replacement of "@" in emails, empty keeps them`)
+	flag.IntVar(&options.Workers, "workers", options.Workers, "goroutines scanning the file, 0 uses every CPU")
+	flag.Int64Var(&options.ChunkSize, "chunk-size", options.ChunkSize, "bytes scanned by a worker at once, 0 means 4 mb")
+	flag.StringVar(&options.Format, "format", options.Format, "format of the users file: json, csv or msgpack, detected when empty")
+	flag.StringVar(&options.Decoder, "decoder", DecoderStream, "how lines are decoded, stream or easyjson")
+	flag.StringVar(&options.IndexPath, "index", options.IndexPath, "index of the users file, built when missing or outdated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [index]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "the index command only builds the index, by default next to the users file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		err = FastSearchWithOptions(os.Stdout, options)
+	case "index":
+		if options.IndexPath == "" {
+			options.IndexPath = options.FilePath + ".idx"
+		}
+		err = BuildIndex(options.FilePath, options.IndexPath)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
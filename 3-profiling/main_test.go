@@ -2,7 +2,16 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mailru/easyjson"
 	"io"
+	"os"
+	"stepikGoWebServices/model"
+	"strings"
 	"testing"
 )
 
@@ -42,3 +51,418 @@ func BenchmarkFast(b *testing.B) {
 		FastSearch(io.Discard)
 	}
 }
+
+func TestSearchQuery(t *testing.T) {
+	options := DefaultSearchOptions()
+	options.Query = `company equals "Flashpoint" AND NOT (job contains "Analyst" OR name matches "^S") OR phone equals "176-88-49"`
+	options.EmailAt = ""
+
+	out := new(bytes.Buffer)
+	if err := FastSearchWithOptions(out, options); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "found users:\n"
+	for i, line := range strings.Split(string(file), "\n") {
+		user := model.User{}
+		if err := json.Unmarshal([]byte(line), &user); err != nil {
+			t.Fatal(err)
+		}
+		if user.Company == "Flashpoint" && !(strings.Contains(user.Job, "Analyst") || strings.HasPrefix(user.Name, "S")) ||
+			user.Phone == "176-88-49" {
+			expected += fmt.Sprintf("[%d] %s <%s>\n", i, user.Name, user.Email)
+		}
+	}
+	// no condition on browsers, so none of them is counted
+	expected += "\nTotal unique browsers 0\n"
+
+	if out.String() != expected {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out.String(), expected)
+	}
+	if !strings.Contains(expected, "[0] Sharon Crawford") {
+		t.Errorf("query selects too little to be meaningful")
+	}
+
+	for query, message := range map[string]string{
+		`browsers contains`:                     "expected a quoted value",
+		`country equals "Chile"`:                "unknown field",
+		`name like "S"`:                         "unknown operator",
+		`(name equals "S"`:                      "missing ')'",
+		`name equals "S" name equals "T"`:       "unexpected 'name'",
+		`name matches "("`:                      "invalid regular expression",
+		`name equals "S`:                        "unterminated string",
+		`NOT name equals "S" and job equals ""`: "",
+	} {
+		_, err := ParseQuery(query)
+		if message == "" && err != nil || message != "" && (err == nil || !strings.Contains(err.Error(), message)) {
+			t.Errorf("query %s\nGot: %v\nExpected: %s", query, err, message)
+		}
+	}
+}
+
+func TestSearchChunks(t *testing.T) {
+	expected := new(bytes.Buffer)
+	SlowSearch(expected)
+
+	// chunks much smaller than the file, some smaller than a single line
+	for _, chunkSize := range []int64{100, 4096, 100000} {
+		options := DefaultSearchOptions()
+		options.Workers = 4
+		options.ChunkSize = chunkSize
+
+		out := new(bytes.Buffer)
+		if err := FastSearchWithOptions(out, options); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected.String() {
+			t.Errorf("results not match for chunks of %d bytes\nGot:\n%v\nExpected:\n%v", chunkSize, out.String(), expected.String())
+		}
+	}
+
+	broken := t.TempDir() + "/users.txt"
+	if err := os.WriteFile(broken, []byte("{\"name\":\"a\"}\n{\"name\":\"b\"}\n{\"name\":\n{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultSearchOptions()
+	options.FilePath = broken
+	options.ChunkSize = 10
+	if err := FastSearchWithOptions(io.Discard, options); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("broken line was not reported, got %v", err)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPath := t.TempDir() + "/users.txt"
+	if err := os.WriteFile(dataPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(query string, indexPath string) string {
+		options := DefaultSearchOptions()
+		options.FilePath = dataPath
+		options.Query = query
+		options.IndexPath = indexPath
+
+		out := new(bytes.Buffer)
+		if err := FastSearchWithOptions(out, options); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	indexPath := dataPath + ".idx"
+	for _, query := range []string{
+		DefaultQuery,
+		`browsers contains "MSIE 8" OR company equals "Flashpoint"`,
+		`browsers contains "SIE" AND job contains "Analyst"`,
+		`name contains "Crawford" AND NOT browsers contains "Android"`,
+		`browsers matches "MSIE [0-9]\\." AND email contains "Muxo.edu"`,
+		`phone equals "-"`,
+	} {
+		if indexed, scanned := search(query, indexPath), search(query, ""); indexed != scanned {
+			t.Errorf("results not match for %s\nGot:\n%v\nExpected:\n%v", query, indexed, scanned)
+		}
+	}
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Errorf("index was not written: %s", err)
+	}
+
+	// a changed data file makes the index outdated
+	// the data has no newline at the end
+	extra := "\n" + `{"browsers":["Android MSIE"],"company":"Newcomer","email":"new@example.com","name":"New User"}`
+	if err := os.WriteFile(dataPath, append(data, extra...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if result := search(DefaultQuery, indexPath); !strings.Contains(result, "[1000] New User <new [at] example.com>") {
+		t.Errorf("index was not rebuilt, got:\n%s", result)
+	}
+}
+
+func TestStreamDecoder(t *testing.T) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	lines = append(lines, []byte(`{"name":"Aé\"b\\c😀","browsers":["x\/y", ""],"extra":{"a":[1,"]}"]},"email":null, "phone" : "1"}`))
+
+	view := &userView{}
+	for i, line := range lines {
+		user := model.User{}
+		if err := easyjson.Unmarshal(line, &user); err != nil {
+			t.Fatal(err)
+		}
+		if err := view.decode(line, true); err != nil {
+			t.Fatalf("line %d: %s", i, err)
+		}
+
+		browsers := make([]string, 0, len(view.browsers))
+		for j := range view.browsers {
+			browsers = append(browsers, string(view.browsers[j].bytes()))
+		}
+		decoded := model.User{
+			Browsers: browsers,
+			Company:  string(view.field(fieldCompany)),
+			Email:    string(view.field(fieldEmail)),
+			Job:      string(view.field(fieldJob)),
+			Name:     string(view.field(fieldName)),
+			Phone:    string(view.field(fieldPhone)),
+		}
+		if fmt.Sprintf("%q", decoded) != fmt.Sprintf("%q", user) {
+			t.Errorf("line %d decoded differently\nGot: %q\nExpected: %q", i, decoded, user)
+		}
+	}
+
+	for _, line := range []string{`{"name":"a"`, `{"name":1}`, `{"name":"a"}x`, `{"browsers":["a",]}`, `["a"]`} {
+		if err := view.decode([]byte(line), true); err == nil {
+			t.Errorf("invalid line %s was accepted", line)
+		}
+	}
+
+	for _, query := range []string{DefaultQuery, `name matches "^S" OR NOT browsers contains "Chrome"`} {
+		results := map[string]string{}
+		for _, decoder := range []string{DecoderStream, DecoderEasyJSON} {
+			options := DefaultSearchOptions()
+			options.Query = query
+			options.Decoder = decoder
+			out := new(bytes.Buffer)
+			if err := FastSearchWithOptions(out, options); err != nil {
+				t.Fatal(err)
+			}
+			results[decoder] = out.String()
+		}
+		if results[DecoderStream] != results[DecoderEasyJSON] {
+			t.Errorf("decoders disagree on %s\nGot:\n%v\nExpected:\n%v", query, results[DecoderStream], results[DecoderEasyJSON])
+		}
+	}
+}
+
+func TestStreamDecoderAllocations(t *testing.T) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+
+	query, err := ParseQuery(DefaultQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := &userSearch{query: query, targetBrowsers: browserConditions(query), emailAt: DefaultEmailAt}
+	result := &chunkResult{browsers: map[string]struct{}{}}
+	view := &userView{}
+
+	scan := func() {
+		result.matches = result.matches[:0]
+		for i, line := range lines {
+			if err := search.scanLine(line, i, view, result); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scan() // the first pass fills the browser set and grows the buffers
+
+	// what is left are the strings of the reported users
+	perLine := testing.AllocsPerRun(10, scan) / float64(len(lines))
+	if perLine > 0.5 {
+		t.Errorf("too many allocations\nGot: %.2f per line\nExpected: <=0.5", perLine)
+	}
+}
+
+// -----
+// go test -bench Line -benchmem, one op is one line
+
+func benchmarkLines(b *testing.B, decoder string) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+
+	query, err := ParseQuery(DefaultQuery)
+	if err != nil {
+		b.Fatal(err)
+	}
+	search := &userSearch{
+		query:          query,
+		targetBrowsers: browserConditions(query),
+		emailAt:        DefaultEmailAt,
+		easyJSON:       decoder == DecoderEasyJSON,
+	}
+	result := &chunkResult{browsers: map[string]struct{}{}}
+	view := &userView{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(lines) == 0 {
+			result.matches = result.matches[:0]
+		}
+		if err := search.scanLine(lines[i%len(lines)], i, view, result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLineEasyJSON(b *testing.B) {
+	benchmarkLines(b, DecoderEasyJSON)
+}
+
+func BenchmarkLineStream(b *testing.B) {
+	benchmarkLines(b, DecoderStream)
+}
+
+func BenchmarkFastEasyJSON(b *testing.B) {
+	options := DefaultSearchOptions()
+	options.Decoder = DecoderEasyJSON
+	for i := 0; i < b.N; i++ {
+		if err := FastSearchWithOptions(io.Discard, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSearchFormats(t *testing.T) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []model.User
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		user := model.User{}
+		if err := easyjson.Unmarshal(line, &user); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	csvData := new(bytes.Buffer)
+	writer := csv.NewWriter(csvData)
+	writer.Write([]string{"name", "unknown", "email", "browsers", "company", "job", "phone"})
+	for _, user := range users {
+		browsers, _ := json.Marshal(user.Browsers)
+		writer.Write([]string{user.Name, "ignored", user.Email, string(browsers), user.Company, user.Job, user.Phone})
+	}
+	writer.Flush()
+
+	msgpackData := new(bytes.Buffer)
+	for _, user := range users {
+		writeMsgpackUser(msgpackData, user)
+	}
+
+	gzipData := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(gzipData)
+	gzipWriter.Write(data)
+	gzipWriter.Close()
+
+	zstdData := new(bytes.Buffer)
+	zstdWriter, err := zstd.NewWriter(zstdData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdWriter.Write(msgpackData.Bytes())
+	zstdWriter.Close()
+
+	expected := new(bytes.Buffer)
+	SlowSearch(expected)
+
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"users.csv":         csvData.Bytes(),
+		"users.msgpack":     msgpackData.Bytes(),
+		"users.txt.gz":      gzipData.Bytes(),
+		"users.msgpack.zst": zstdData.Bytes(),
+	} {
+		options := DefaultSearchOptions()
+		options.FilePath = dir + "/" + name
+		if err := os.WriteFile(options.FilePath, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		out := new(bytes.Buffer)
+		if err := FastSearchWithOptions(out, options); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if out.String() != expected.String() {
+			t.Errorf("results not match for %s\nGot:\n%v\nExpected:\n%v", name, out, expected)
+		}
+	}
+
+	options := DefaultSearchOptions()
+	options.Format = "xml"
+	if err := FastSearchWithOptions(io.Discard, options); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+
+	// corrupt sizes are reported instead of allocated
+	for name, content := range map[string][]byte{
+		"string.msgpack": {0x81, 0xa4, 'n', 'a', 'm', 'e', 0xdb, 0xff, 0xff, 0xff, 0xff},
+		"array.msgpack":  {0x81, 0xa8, 'b', 'r', 'o', 'w', 's', 'e', 'r', 's', 0xdd, 0xff, 0xff, 0xff, 0xff},
+	} {
+		options := DefaultSearchOptions()
+		options.FilePath = dir + "/" + name
+		if err := os.WriteFile(options.FilePath, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := FastSearchWithOptions(io.Discard, options); err == nil {
+			t.Errorf("%s: expected an error for a corrupt size", name)
+		}
+	}
+	// an ignored field nested deeper than any stack allows is still skipped
+	deep := new(bytes.Buffer)
+	deep.Write([]byte{0x82, 0xa4, 'n', 'a', 'm', 'e', 0xa4, 'D', 'e', 'e', 'p', 0xa5, 'e', 'x', 't', 'r', 'a'})
+	deep.Write(bytes.Repeat([]byte{0x91}, 10_000_000))
+	deep.WriteByte(0xc0)
+	options = DefaultSearchOptions()
+	options.FilePath = dir + "/deep.msgpack"
+	if err := os.WriteFile(options.FilePath, deep.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := FastSearchWithOptions(io.Discard, options); err != nil {
+		t.Errorf("deeply nested value was not skipped: %s", err)
+	}
+}
+
+// writeMsgpackUser encodes user with an extra number and map the decoder has to skip.
+func writeMsgpackUser(out *bytes.Buffer, user model.User) {
+	writeString := func(value string) {
+		switch {
+		case len(value) < 32:
+			out.WriteByte(0xa0 | byte(len(value)))
+		default:
+			out.Write([]byte{0xda, byte(len(value) >> 8), byte(len(value))})
+		}
+		out.WriteString(value)
+	}
+
+	out.WriteByte(0x80 | 8)
+	writeString("browsers")
+	out.Write([]byte{0xdc, byte(len(user.Browsers) >> 8), byte(len(user.Browsers))})
+	for _, browser := range user.Browsers {
+		writeString(browser)
+	}
+	for _, field := range [][2]string{
+		{"company", user.Company}, {"email", user.Email}, {"job", user.Job},
+		{"name", user.Name}, {"phone", user.Phone},
+	} {
+		writeString(field[0])
+		writeString(field[1])
+	}
+	writeString("age")
+	out.Write([]byte{0xcd, 0x01, 0x00})
+	writeString("address")
+	out.WriteByte(0x82)
+	writeString("city")
+	writeString("Moscow")
+	writeString("zip")
+	out.Write([]byte{0x92, 0x07, 0xc0})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"stepikGoWebServices/model"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultQuery selects the users FastSearch has always looked for.
+const DefaultQuery = `browsers contains "Android" AND browsers contains "MSIE"`
+
+// Query decides whether a user is reported.
+//
+// The language is a list of conditions `field operator "value"` joined with
+// AND, OR, NOT and parentheses, keywords are case-insensitive and AND binds tighter than OR.
+// Fields are browsers, company, email, job, name and phone, operators are
+// contains, equals and matches (a regular expression). A condition on browsers
+// holds if it holds for at least one browser of the user.
+type Query interface {
+	Match(user *model.User) bool
+	matchView(view *userView) bool
+}
+
+type andQuery struct {
+	left, right Query
+}
+
+func (q andQuery) Match(user *model.User) bool {
+	return q.left.Match(user) && q.right.Match(user)
+}
+
+func (q andQuery) matchView(view *userView) bool {
+	return q.left.matchView(view) && q.right.matchView(view)
+}
+
+type orQuery struct {
+	left, right Query
+}
+
+func (q orQuery) Match(user *model.User) bool {
+	return q.left.Match(user) || q.right.Match(user)
+}
+
+func (q orQuery) matchView(view *userView) bool {
+	return q.left.matchView(view) || q.right.matchView(view)
+}
+
+type notQuery struct {
+	query Query
+}
+
+func (q notQuery) Match(user *model.User) bool {
+	return !q.query.Match(user)
+}
+
+func (q notQuery) matchView(view *userView) bool {
+	return !q.query.matchView(view)
+}
+
+// condition compares one field with a value.
+type condition struct {
+	field    string
+	operator string
+	value    string
+	regexp   *regexp.Regexp
+	// valueBytes and userField serve matchView
+	valueBytes []byte
+	userField  userField
+}
+
+func (c *condition) Match(user *model.User) bool {
+	switch c.field {
+	case "browsers":
+		for _, browser := range user.Browsers {
+			if c.matchValue(browser) {
+				return true
+			}
+		}
+		return false
+	case "company":
+		return c.matchValue(user.Company)
+	case "email":
+		return c.matchValue(user.Email)
+	case "job":
+		return c.matchValue(user.Job)
+	case "name":
+		return c.matchValue(user.Name)
+	default:
+		return c.matchValue(user.Phone)
+	}
+}
+
+func (c *condition) matchView(view *userView) bool {
+	if c.field != "browsers" {
+		return c.matchBytes(view.field(c.userField))
+	}
+
+	for i := range view.browsers {
+		if c.matchBytes(view.browsers[i].bytes()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *condition) matchBytes(value []byte) bool {
+	switch c.operator {
+	case "contains":
+		return bytes.Contains(value, c.valueBytes)
+	case "equals":
+		return bytes.Equal(value, c.valueBytes)
+	default:
+		return c.regexp.Match(value)
+	}
+}
+
+func (c *condition) matchValue(value string) bool {
+	switch c.operator {
+	case "contains":
+		return strings.Contains(value, c.value)
+	case "equals":
+		return value == c.value
+	default:
+		return c.regexp.MatchString(value)
+	}
+}
+
+var queryFields = []string{"browsers", "company", "email", "job", "name", "phone"}
+
+// browserConditions returns the conditions on browsers, whatever their place in the query.
+// FastSearch counts the unique browsers satisfying any of them.
+func browserConditions(query Query) []*condition {
+	switch query := query.(type) {
+	case andQuery:
+		return append(browserConditions(query.left), browserConditions(query.right)...)
+	case orQuery:
+		return append(browserConditions(query.left), browserConditions(query.right)...)
+	case notQuery:
+		return browserConditions(query.query)
+	case *condition:
+		if query.field == "browsers" {
+			return []*condition{query}
+		}
+	}
+	return nil
+}
+
+// ParseQuery compiles a query, see Query for the syntax.
+func ParseQuery(source string) (Query, error) {
+	var tokens, err = tokenizeQuery(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var parser = &queryParser{tokens: tokens}
+	query, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.done() {
+		return nil, fmt.Errorf("unexpected '%s' in query", parser.peek().text)
+	}
+	return query, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeQuery(source string) ([]queryToken, error) {
+	var tokens = make([]queryToken, 0)
+
+	for i := 0; i < len(source); {
+		var char = rune(source[i])
+
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case char == '(' || char == ')':
+			tokens = append(tokens, queryToken{text: string(char)})
+			i++
+		case char == '"':
+			var end = i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string in query at offset %d", i)
+			}
+
+			var value, err = strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s in query", source[i:end+1])
+			}
+			tokens = append(tokens, queryToken{text: value, quoted: true})
+			i = end + 1
+		default:
+			var end = i
+			for end < len(source) && !unicode.IsSpace(rune(source[end])) && !strings.ContainsRune(`()"`, rune(source[end])) {
+				end++
+			}
+			tokens = append(tokens, queryToken{text: source[i:end]})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens   []queryToken
+	position int
+}
+
+func (p *queryParser) done() bool {
+	return p.position >= len(p.tokens)
+}
+
+func (p *queryParser) peek() queryToken {
+	if p.done() {
+		return queryToken{}
+	}
+	return p.tokens[p.position]
+}
+
+// keyword consumes the next token if it is the given unquoted keyword.
+func (p *queryParser) keyword(keyword string) bool {
+	var token = p.peek()
+	if p.done() || token.quoted || !strings.EqualFold(token.text, keyword) {
+		return false
+	}
+	p.position++
+	return true
+}
+
+func (p *queryParser) parseOr() (Query, error) {
+	var left, err = p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		var right, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orQuery{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (Query, error) {
+	var left, err = p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		var right, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andQuery{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (Query, error) {
+	if p.keyword("not") {
+		var query, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notQuery{query: query}, nil
+	}
+
+	if p.keyword("(") {
+		var query, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("missing ')' in query")
+		}
+		return query, nil
+	}
+
+	return p.parseCondition()
+}
+
+func (p *queryParser) parseCondition() (Query, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+
+	var field = strings.ToLower(p.peek().text)
+	if p.peek().quoted || !slices.Contains(queryFields, field) {
+		return nil, fmt.Errorf("unknown field '%s' in query, expected one of %s", p.peek().text, strings.Join(queryFields, ", "))
+	}
+	p.position++
+
+	var operator = strings.ToLower(p.peek().text)
+	if p.done() || p.peek().quoted || (operator != "contains" && operator != "equals" && operator != "matches") {
+		return nil, fmt.Errorf("unknown operator '%s' after '%s', expected contains, equals or matches", p.peek().text, field)
+	}
+	p.position++
+
+	if !p.peek().quoted {
+		return nil, fmt.Errorf("expected a quoted value after '%s %s'", field, operator)
+	}
+	var value = p.peek().text
+	p.position++
+
+	var result = &condition{field: field, operator: operator, value: value, valueBytes: []byte(value)}
+	if field != "browsers" {
+		result.userField = userField(slices.Index(userFieldNames[:], field))
+	}
+	if operator == "matches" {
+		var compiled, err = regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s' in query: %s", value, err)
+		}
+		result.regexp = compiled
+	}
+	return result, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type userField int
+
+const (
+	fieldCompany userField = iota
+	fieldEmail
+	fieldJob
+	fieldName
+	fieldPhone
+	fieldCount
+)
+
+var userFieldNames = [fieldCount]string{
+	fieldCompany: "company",
+	fieldEmail:   "email",
+	fieldJob:     "job",
+	fieldName:    "name",
+	fieldPhone:   "phone",
+}
+
+// jsonString is a string value still in the line, it is unescaped only when read.
+type jsonString struct {
+	raw     []byte
+	escaped bool
+	decoded []byte
+}
+
+// bytes is valid until the next line is decoded.
+func (s *jsonString) bytes() []byte {
+	if !s.escaped {
+		return s.raw
+	}
+	s.decoded = appendUnescaped(s.decoded[:0], s.raw)
+	return s.decoded
+}
+
+// userView is the allocation-free counterpart of model.User: its strings point into
+// the decoded line and its buffers are reused from line to line.
+type userView struct {
+	fields   [fieldCount]jsonString
+	browsers []jsonString
+}
+
+func (v *userView) field(field userField) []byte {
+	return v.fields[field].bytes()
+}
+
+// decode reads one JSON object, unknown fields are skipped like easyjson does.
+// Browsers are only read when withBrowsers is set.
+func (v *userView) decode(line []byte, withBrowsers bool) error {
+	for i := range v.fields {
+		v.fields[i].raw, v.fields[i].escaped = nil, false
+	}
+	v.browsers = v.browsers[:0]
+
+	var cursor = jsonCursor{data: line}
+	cursor.skipSpace()
+	if !cursor.consume('{') {
+		return cursor.fail("expected '{'")
+	}
+
+	for first := true; ; first = false {
+		cursor.skipSpace()
+		if cursor.consume('}') {
+			break
+		}
+		if !first && !cursor.consume(',') {
+			return cursor.fail("expected ',' or '}'")
+		}
+
+		cursor.skipSpace()
+		var key, keyEscaped, err = cursor.readString()
+		if err != nil {
+			return err
+		}
+		cursor.skipSpace()
+		if !cursor.consume(':') {
+			return cursor.fail("expected ':'")
+		}
+		cursor.skipSpace()
+
+		if keyEscaped {
+			key = appendUnescaped(nil, key)
+		}
+		err = v.decodeField(&cursor, key, withBrowsers)
+		if err != nil {
+			return err
+		}
+	}
+
+	cursor.skipSpace()
+	if cursor.position != len(cursor.data) {
+		return cursor.fail("unexpected data after the object")
+	}
+	return nil
+}
+
+func (v *userView) decodeField(cursor *jsonCursor, key []byte, withBrowsers bool) error {
+	if string(key) == "browsers" {
+		switch {
+		case cursor.consumeLiteral("null"):
+			return nil
+		case !withBrowsers:
+			return cursor.skipValue()
+		default:
+			return v.decodeBrowsers(cursor)
+		}
+	}
+
+	for field, name := range userFieldNames {
+		if string(key) != name {
+			continue
+		}
+		if cursor.consumeLiteral("null") {
+			return nil
+		}
+
+		var raw, escaped, err = cursor.readString()
+		v.fields[field].raw, v.fields[field].escaped = raw, escaped
+		return err
+	}
+
+	return cursor.skipValue()
+}
+
+func (v *userView) decodeBrowsers(cursor *jsonCursor) error {
+	if !cursor.consume('[') {
+		return cursor.fail("expected an array of browsers")
+	}
+
+	for first := true; ; first = false {
+		cursor.skipSpace()
+		if cursor.consume(']') {
+			return nil
+		}
+		if !first && !cursor.consume(',') {
+			return cursor.fail("expected ',' or ']'")
+		}
+		cursor.skipSpace()
+
+		var raw, escaped, err = cursor.readString()
+		if err != nil {
+			return err
+		}
+
+		// the elements keep their decoding buffers when the slice is reused
+		if len(v.browsers) < cap(v.browsers) {
+			v.browsers = v.browsers[:len(v.browsers)+1]
+		} else {
+			v.browsers = append(v.browsers, jsonString{})
+		}
+		var browser = &v.browsers[len(v.browsers)-1]
+		browser.raw, browser.escaped = raw, escaped
+	}
+}
+
+type jsonCursor struct {
+	data     []byte
+	position int
+}
+
+func (c *jsonCursor) fail(message string) error {
+	return fmt.Errorf("parse error: %s at offset %d", message, c.position)
+}
+
+func (c *jsonCursor) skipSpace() {
+	for c.position < len(c.data) {
+		switch c.data[c.position] {
+		case ' ', '\t', '\r', '\n':
+			c.position++
+		default:
+			return
+		}
+	}
+}
+
+func (c *jsonCursor) consume(char byte) bool {
+	if c.position < len(c.data) && c.data[c.position] == char {
+		c.position++
+		return true
+	}
+	return false
+}
+
+func (c *jsonCursor) consumeLiteral(literal string) bool {
+	if len(c.data)-c.position >= len(literal) && string(c.data[c.position:c.position+len(literal)]) == literal {
+		c.position += len(literal)
+		return true
+	}
+	return false
+}
+
+// readString returns the raw content of a string, escaped tells whether it needs unescaping.
+func (c *jsonCursor) readString() ([]byte, bool, error) {
+	if !c.consume('"') {
+		return nil, false, c.fail("expected a string")
+	}
+
+	var start = c.position
+	var escaped = false
+	for c.position < len(c.data) {
+		switch c.data[c.position] {
+		case '"':
+			c.position++
+			return c.data[start : c.position-1], escaped, nil
+		case '\\':
+			escaped = true
+			c.position += 2
+		default:
+			c.position++
+		}
+	}
+
+	return nil, false, c.fail("unterminated string")
+}
+
+func (c *jsonCursor) skipValue() error {
+	if c.position >= len(c.data) {
+		return c.fail("expected a value")
+	}
+
+	switch c.data[c.position] {
+	case '"':
+		var _, _, err = c.readString()
+		return err
+	case '{', '[':
+		var depth = 0
+		for c.position < len(c.data) {
+			switch c.data[c.position] {
+			case '"':
+				var _, _, err = c.readString()
+				if err != nil {
+					return err
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			c.position++
+
+			if depth == 0 {
+				return nil
+			}
+		}
+		return c.fail("unterminated value")
+	default:
+		var start = c.position
+		for c.position < len(c.data) {
+			switch c.data[c.position] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				if c.position == start {
+					return c.fail("expected a value")
+				}
+				return nil
+			}
+			c.position++
+		}
+		return nil
+	}
+}
+
+var errInvalidEscape = errors.New("invalid escape")
+
+// appendUnescaped decodes the escapes of a JSON string, invalid ones are kept as they are.
+func appendUnescaped(decoded []byte, raw []byte) []byte {
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' || i+1 == len(raw) {
+			decoded = append(decoded, raw[i])
+			continue
+		}
+
+		i++
+		switch raw[i] {
+		case 'b':
+			decoded = append(decoded, '\b')
+		case 'f':
+			decoded = append(decoded, '\f')
+		case 'n':
+			decoded = append(decoded, '\n')
+		case 'r':
+			decoded = append(decoded, '\r')
+		case 't':
+			decoded = append(decoded, '\t')
+		case 'u':
+			var char, size, err = unescapeRune(raw[i+1:])
+			if err != nil {
+				decoded = append(decoded, '\\', 'u')
+				continue
+			}
+			decoded = utf8.AppendRune(decoded, char)
+			i += size
+		default:
+			decoded = append(decoded, raw[i])
+		}
+	}
+	return decoded
+}
+
+// unescapeRune reads the XXXX of \uXXXX, followed by a second one for a surrogate pair.
+func unescapeRune(raw []byte) (rune, int, error) {
+	var first, err = hexRune(raw)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !utf16.IsSurrogate(first) {
+		return first, 4, nil
+	}
+
+	if len(raw) >= 10 && raw[4] == '\\' && raw[5] == 'u' {
+		var second, err = hexRune(raw[6:])
+		if err == nil {
+			if char := utf16.DecodeRune(first, second); char != utf8.RuneError {
+				return char, 10, nil
+			}
+		}
+	}
+	return utf8.RuneError, 4, nil
+}
+
+func hexRune(raw []byte) (rune, error) {
+	if len(raw) < 4 {
+		return 0, errInvalidEscape
+	}
+
+	var value rune
+	for _, digit := range raw[:4] {
+		switch {
+		case '0' <= digit && digit <= '9':
+			value = value<<4 | rune(digit-'0')
+		case 'a' <= digit && digit <= 'f':
+			value = value<<4 | rune(digit-'a'+10)
+		case 'A' <= digit && digit <= 'F':
+			value = value<<4 | rune(digit-'A'+10)
+		default:
+			return 0, errInvalidEscape
+		}
+	}
+	return value, nil
+}